@@ -1,11 +1,14 @@
 package account
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
 	"math"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -22,10 +25,16 @@ type Config struct {
 	Btcd  btcd.Btcd
 	Mongo mongo.Mongo
 	Redis rs.Redis
+	// SkipStateKey bypasses the handshake of state key on redis set by the service
+	// and treats every address as already existing, which is safe but looks up redis/database first
+	SkipStateKey bool
+	// RequiredConfirmations is the number of confirmations which transactions must exceed to be stored to database
+	RequiredConfirmations uint64
+	// MaxSeriesPoints is the max number of points of a balance series, which is unlimited if not positive
+	MaxSeriesPoints int
 }
 
 const maxRequestedTransactionsRecord = 2000
-const requiredConfirmations = 6
 const satoshi float64 = 100000000
 
 type userData struct {
@@ -33,13 +42,86 @@ type userData struct {
 	Unspents     []*mongo.Unspent
 	Spents       map[string]*bool
 	Total        int64
+	Unconfirmed  int64
+	Pending      Pending
+	// Confirmations of transactions fetched from btcd, which leaves out those restored from database/redis
+	Confirmations map[string]uint64
+	// Spenders maps keys of outputs to transactions spending them
+	Spenders map[string]string
+	Details  []mongo.TxDetail
+}
+
+// Pending lists transactions of the address not confirmed yet, which are never persisted
+// Transactions spending from the address are outgoing, otherwise incoming
+type Pending struct {
+	Incoming []string `json:"incoming"`
+	Outgoing []string `json:"outgoing"`
+}
+
+// BalanceDetail splits the balance in satoshis by confirmation
+// Unconfirmed is the change of the balance made by transactions not confirmed enough, which might be negative
+type BalanceDetail struct {
+	Confirmed   int64
+	Unconfirmed int64
+	Pending     Pending
+}
+
+// HistoryEntry details the transaction of the address with amounts in satoshis
+// Net is the change of the balance made by the transaction, which is negative when spending
+type HistoryEntry struct {
+	Transaction   string `json:"txid"`
+	BlockTime     uint64 `json:"blockTime"`
+	Height        uint64 `json:"height"`
+	Confirmations uint64 `json:"confirmations"`
+	Received      int64  `json:"received"`
+	Sent          int64  `json:"sent"`
+	Net           int64  `json:"net"`
+}
+
+// Point selects the moment in the history of the address by block height, or by block time if Time is given
+type Point struct {
+	Height uint64
+	Time   time.Time
+}
+
+// HistoricalBalance is the confirmed balance in satoshis as of the point along with unspent outputs then
+type HistoricalBalance struct {
+	Balance  int64
+	Unspents []mongo.Unspent
+}
+
+// Intervals of balance series
+const (
+	IntervalTransaction string = "tx"
+	IntervalDay         string = "day"
+	IntervalMonth       string = "month"
+)
+
+// BalancePoint is the balance in satoshis as of the time, inclusive
+// It is the balance after the transaction for interval 'tx', otherwise at the last second of the period or at the end
+// of the range for the period in progress
+type BalancePoint struct {
+	Time        time.Time `json:"time"`
+	Transaction string    `json:"txid,omitempty"`
+	Balance     int64     `json:"balance"`
 }
 
 // UserData is ideal data schema for 'GetAddressResult'
+// Balance counts confirmed transactions only, the same as Confirmed
 type UserData struct {
 	Balance      float64         `json:"balance"`
 	Transactions []string        `json:"transactions"`
 	Unspents     []mongo.Unspent `json:"unspents"`
+	Confirmed    float64         `json:"confirmed"`
+	Unconfirmed  float64         `json:"unconfirmed"`
+	Pending      Pending         `json:"pending"`
+	// detail is the exact balance, which balances above are derived from
+	detail BalanceDetail
+}
+
+// BalanceDetail returns the exact balance in satoshis
+func (u UserData) BalanceDetail() BalanceDetail {
+	return u.detail
 }
 
 // ToJSON encodes itself to JSON string represented in []byte
@@ -69,6 +151,9 @@ func createUserHistory(
 	txs []string,
 	skpt uint64,
 	subtotal int64,
+	blks []mongo.Block,
+	dtls []mongo.TxDetail,
+	sptbs map[string]string,
 ) *mongo.UserHistory {
 	_unspts := make([]mongo.Unspent, 0)
 
@@ -86,6 +171,9 @@ func createUserHistory(
 		Shadowspents: shadowspts,
 		Transactions: txs,
 		Skipped:      skpt,
+		Blocks:       blks,
+		Details:      dtls,
+		Spenders:     sptbs,
 	}
 }
 
@@ -104,7 +192,7 @@ func combineUserHistory(a1 *mongo.UserHistory, a2 *mongo.UserHistory) (*mongo.Us
 	cSpts := a1.Spents
 	for key, val := range a2.Spents {
 		if _, ok := cSpts[key]; ok {
-			err := errors.New("Conflict occurred during the merge op from a2 into a1: " + key)
+			err := CorruptedDataError{Key: key, Reason: "Conflict occurred during the merge op from a2 into a1"}
 			return nil, err
 		}
 
@@ -114,13 +202,26 @@ func combineUserHistory(a1 *mongo.UserHistory, a2 *mongo.UserHistory) (*mongo.Us
 	cUsptAmts := a1.UnspentAmts
 	for key, val := range a2.UnspentAmts {
 		if _, ok := cUsptAmts[key]; ok {
-			err := errors.New("Conflict occurred during the merge op from b2 into a1: " + key)
+			err := CorruptedDataError{Key: key, Reason: "Conflict occurred during the merge op from b2 into a1"}
 			return nil, err
 		}
 
 		cUsptAmts[key] = val
 	}
 
+	cSptbs := make(map[string]string, 0)
+	for key, val := range a1.Spenders {
+		cSptbs[key] = val
+	}
+	for key, val := range a2.Spenders {
+		if _, ok := cSptbs[key]; ok {
+			err := CorruptedDataError{Key: key, Reason: "Conflict occurred during the merge op of spenders from a2 into a1"}
+			return nil, err
+		}
+
+		cSptbs[key] = val
+	}
+
 	return &mongo.UserHistory{
 		Address:      a1.Address,
 		Timestamp:    a2.Timestamp,
@@ -131,6 +232,10 @@ func combineUserHistory(a1 *mongo.UserHistory, a2 *mongo.UserHistory) (*mongo.Us
 		Shadowspents: append(a1.Shadowspents, a2.Shadowspents...),
 		Transactions: append(a1.Transactions, a2.Transactions...),
 		Skipped:      a2.Skipped,
+		Blocks:       append(a1.Blocks, a2.Blocks...),
+		Details:      append(a1.Details, a2.Details...),
+		Spenders:     cSptbs,
+		Backfilled:   a1.Backfilled,
 	}, nil
 }
 
@@ -186,29 +291,375 @@ func restoreSpentStates(result map[string]*bool, shadowSpts []string) error {
 	return nil
 }
 
+// summarizePending lists pending transactions and sums up the change of the balance made by them
+// Outputs of the address spent by them are looked up from confirmed ones, then from pending ones
+func summarizePending(lg *log.Logger, targetAddr string, txs []btcd.ResponseSearchRawTransactions, unspentAmts map[string]uint64) (Pending, int64) {
+	pending := Pending{
+		Incoming: make([]string, 0),
+		Outgoing: make([]string, 0),
+	}
+	pendingAmts := make(map[string]uint64, 0)
+	delta := int64(0)
+	for _, tx := range txs {
+		for idx, vout := range tx.Vouts {
+			if containsAddr(vout.ScriptPubKey.Addresses, targetAddr) {
+				amt := uint64(math.Round(vout.Value * satoshi))
+				pendingAmts[tx.Txid+"+"+strconv.Itoa(idx)] = amt
+				delta += int64(amt)
+			}
+		}
+	}
+
+	for _, tx := range txs {
+		outgoing := false
+		for _, vin := range tx.Vins {
+			if containsAddr(vin.PrevOut.Addresses, targetAddr) {
+				outgoing = true
+				key := vin.Txid + "+" + strconv.FormatUint(vin.VoutIndex, 10)
+				amt, ok := unspentAmts[key]
+				if !ok {
+					amt, ok = pendingAmts[key]
+				}
+				if !ok {
+					lg.Println("Could not find the output spent by pending transaction: key => " + key)
+					continue
+				}
+				delta -= int64(amt)
+			}
+		}
+
+		if outgoing {
+			pending.Outgoing = append(pending.Outgoing, tx.Txid)
+		} else {
+			pending.Incoming = append(pending.Incoming, tx.Txid)
+		}
+	}
+	return pending, delta
+}
+
+// tipHeight returns the height of the best block on the main chain of the node
+func tipHeight(node btcd.Btcd) (uint64, error) {
+	info, err := node.GetInfo()
+	if err != nil {
+		return 0, err
+	}
+	blocks, ok := (*info)["blocks"].(float64)
+	if !ok {
+		return 0, errors.New("Could not find block height in the info of btcd")
+	}
+	return uint64(blocks), nil
+}
+
+// onMainChain tells whether the block is still on the main chain of the node, that is the block at its height
+// on the main chain is the same one. It holds for side chains kept by the node as well as those dropped
+func onMainChain(node btcd.Btcd, blk mongo.Block) (bool, error) {
+	hash, err := node.GetBlockHash(blk.Height)
+	if err != nil {
+		if err.Error() == btcd.ErrorBlockHeightOutOfRange {
+			return false, nil
+		}
+		return false, err
+	}
+	return hash == blk.Hash, nil
+}
+
+// maxTipRaces is the number of times a page of transactions is fetched again as the best block moves meanwhile
+const maxTipRaces = 3
+
+// searchTransactions fetches the page of transactions of the address from start, along with the height of the best
+// block which confirmations of them are counted from, so that heights of their blocks are derived from confirmations
+// The tip is read before the page unless given (0 if unknown) and read again after the page if the page holds
+// transactions confirmed more than required, which is fetched again if the tip moves meanwhile
+func searchTransactions(node btcd.Btcd, addr string, start int64, tip uint64, required uint64) (*[]btcd.ResponseSearchRawTransactions, uint64, error) {
+	for races := 0; ; races++ {
+		if tip == 0 {
+			var err error
+			tip, err = tipHeight(node)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+
+		res, err := node.SearchRawTransactions(addr, start, maxRequestedTransactionsRecord)
+		if err != nil {
+			return nil, tip, err
+		}
+		deep := false
+		for _, tx := range *res {
+			if tx.Confirmations > required {
+				deep = true
+				break
+			}
+		}
+		if !deep {
+			return res, tip, nil
+		}
+
+		after, err := tipHeight(node)
+		if err != nil {
+			return nil, 0, err
+		}
+		if after == tip {
+			return res, tip, nil
+		}
+		if races == maxTipRaces {
+			return nil, 0, errors.New("Best block keeps moving while fetching transactions")
+		}
+		tip = after
+	}
+}
+
+// heightOf derives the height of the block of the transaction from its confirmations counted from the tip
+func heightOf(tx btcd.ResponseSearchRawTransactions, tip uint64) uint64 {
+	if tx.Confirmations > tip+1 {
+		return 0
+	}
+	return tip + 1 - tx.Confirmations
+}
+
+// maxVerifiedBlocks is the number of the newest blocks of stored transactions checked against the main chain
+// Transactions are stored once confirmed more than required, so reorganizations hardly reach deeper ones
+const maxVerifiedBlocks = 2
+
+// verifiedTip remembers addresses whose stored blocks are verified at the best block of the hash
+// It is reset as soon as the best block changes, so it holds addresses requested within one block at most
+type verifiedTip struct {
+	mu    sync.Mutex
+	hash  string
+	addrs map[string]bool
+}
+
+var verifiedTips = &verifiedTip{}
+
+func (v *verifiedTip) verified(hash string, addr string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.hash == hash && v.addrs[addr]
+}
+
+func (v *verifiedTip) add(hash string, addr string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.hash != hash {
+		v.hash = hash
+		v.addrs = make(map[string]bool)
+	}
+	v.addrs[addr] = true
+}
+
+// verifyUserHistory checks the newest blocks of stored transactions against the main chain unless the best block
+// is unchanged since the last check of the address
+// Once a block is found orphaned by reorganization, documents in database from the one holding blocks at the height of
+// the lowest orphaned block onwards are rolled back along with cached data on redis, or all of them if none of
+// the blocks checked is still on the main chain.
+// It returns the history remaining in database (nil if nothing remains) and whether it is rolled back
+// Legacy segments stored without blocks are skipped until they are backfilled by backfillUserHistory
+func verifyUserHistory(acc *account, targetAddr string, preDB *mongo.UserHistory) (*mongo.UserHistory, bool, error) {
+	blocks := make([]mongo.Block, 0)
+	seen := make(map[string]bool, 0)
+	for _, blk := range preDB.Blocks {
+		if blk.Hash != "" && !seen[blk.Hash] {
+			seen[blk.Hash] = true
+			blocks = append(blocks, blk)
+		}
+	}
+	if len(blocks) == 0 {
+		return preDB, false, nil
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Height > blocks[j].Height
+	})
+	if len(blocks) > maxVerifiedBlocks {
+		blocks = blocks[:maxVerifiedBlocks]
+	}
+
+	tipHash, err := acc.config.Btcd.GetBestBlockHash()
+	if err != nil {
+		acc.customLogger2.LogOnError(err, "Fails on the request of the best block")
+		return nil, false, BackendError{Backend: BackendBtcd, Err: err}
+	}
+	if verifiedTips.verified(tipHash, targetAddr) {
+		return preDB, false, nil
+	}
+
+	rollbackHeight := uint64(0)
+	orphaned := false
+	for i, blk := range blocks {
+		ok, err := onMainChain(acc.config.Btcd, blk)
+		if err != nil {
+			acc.customLogger2.LogOnError(err, "Fails on checking the block of stored transactions: hash => "+blk.Hash)
+			return nil, false, BackendError{Backend: BackendBtcd, Err: err}
+		}
+		if ok {
+			if orphaned {
+				rollbackHeight = blocks[i-1].Height
+			}
+			break
+		}
+		acc.customLogger.Println("Detected orphaned block of stored transaction: tx => " + blk.Transaction + ", hash => " + blk.Hash)
+		orphaned = true
+	}
+	if !orphaned {
+		verifiedTips.add(tipHash, targetAddr)
+		return preDB, false, nil
+	}
+
+	removed, err := acc.config.Mongo.RollbackUserHistory(targetAddr, rollbackHeight)
+	if err != nil {
+		acc.customLogger2.LogOnError(err, "Fails on rolling back user history in database")
+		return nil, false, BackendError{Backend: BackendMongo, Err: err}
+	}
+	acc.customLogger.Println("Rolled back " + strconv.Itoa(removed) + " documents of user history from height " + strconv.FormatUint(rollbackHeight, 10))
+
+	key := utils.GenCacheKey(targetAddr, rs.CommandAll)
+	if err := acc.config.Redis.Del(key); err != nil {
+		acc.customLogger2.LogOnError(err, "Fails on removing cached data on redis")
+		return nil, false, BackendError{Backend: BackendRedis, Err: err}
+	}
+
+	remaining, err := acc.config.Mongo.GetUserHistory(targetAddr)
+	if err != nil {
+		if err.Error() == mongo.ErrorNoUserInfo {
+			return nil, true, nil
+		}
+		acc.customLogger2.LogOnError(err, "Fails on the request of cached user detailed transaction history")
+		return nil, false, BackendError{Backend: BackendMongo, Err: err}
+	}
+	return remaining, true, nil
+}
+
+// backfillUserHistory rescans transactions of legacy segments stored before blocks, details and spenders are recorded
+// and rewrites their documents in database marked as backfilled, so that every address is rescanned once
+// Transactions btcd could not find any more are left without details for good
+// Amounts spent are taken from outputs stored. It returns the history reloaded from database and whether it is backfilled
+func backfillUserHistory(ctx context.Context, acc *account, targetAddr string, preDB *mongo.UserHistory) (*mongo.UserHistory, bool, error) {
+	if preDB.Backfilled {
+		return preDB, false, nil
+	}
+	recorded := make(map[string]bool, 0)
+	for _, detail := range preDB.Details {
+		recorded[detail.Transaction] = true
+	}
+	legacy := make(map[string]bool, 0)
+	for _, txid := range preDB.Transactions {
+		if !recorded[txid] {
+			legacy[txid] = true
+		}
+	}
+	if len(legacy) == 0 {
+		return preDB, false, nil
+	}
+	acc.customLogger.Println("Backfilling " + strconv.Itoa(len(legacy)) + " transactions stored before details are recorded")
+
+	node := acc.config.Btcd
+	tip := uint64(0)
+	blocks := make([]mongo.Block, 0)
+	details := make([]mongo.TxDetail, 0)
+	spenders := make(map[string]string, 0)
+	for start := int64(0); start < int64(preDB.Skipped) && len(details) < len(legacy); start += maxRequestedTransactionsRecord {
+		if err := ctx.Err(); err != nil {
+			acc.customLogger2.LogOnError(err, "Gives up backfilling user history")
+			return nil, false, err
+		}
+
+		var res *[]btcd.ResponseSearchRawTransactions
+		var err error
+		res, tip, err = searchTransactions(node, targetAddr, start, tip, 0)
+		if err != nil {
+			if err.Error() == btcd.ErrorNoDataReturned {
+				break
+			}
+			acc.customLogger2.LogOnError(err, "Fails on the request of user detailed transaction history")
+			return nil, false, BackendError{Backend: BackendBtcd, Err: err}
+		}
+
+		for _, tx := range *res {
+			if !legacy[tx.Txid] {
+				continue
+			}
+			height := heightOf(tx, tip)
+
+			received := uint64(0)
+			for _, vout := range tx.Vouts {
+				if containsAddr(vout.ScriptPubKey.Addresses, targetAddr) {
+					received += uint64(math.Round(vout.Value * satoshi))
+				}
+			}
+			sent := uint64(0)
+			for _, vin := range tx.Vins {
+				if containsAddr(vin.PrevOut.Addresses, targetAddr) {
+					key := vin.Txid + "+" + strconv.FormatUint(vin.VoutIndex, 10)
+					sent += preDB.UnspentAmts[key]
+					spenders[key] = tx.Txid
+				}
+			}
+
+			blocks = append(blocks, mongo.Block{
+				Transaction: tx.Txid,
+				Hash:        tx.Blockhash,
+				Height:      height,
+			})
+			details = append(details, mongo.TxDetail{
+				Transaction: tx.Txid,
+				BlockTime:   tx.Blocktime,
+				Height:      height,
+				Received:    received,
+				Sent:        sent,
+			})
+		}
+
+		if len(*res) < maxRequestedTransactionsRecord {
+			break
+		}
+	}
+	if len(details) < len(legacy) {
+		acc.customLogger.Println("Could not find " + strconv.Itoa(len(legacy)-len(details)) + " stored transactions on btcd")
+	}
+
+	rewritten, err := acc.config.Mongo.BackfillUserHistory(targetAddr, blocks, details, spenders)
+	if err != nil {
+		acc.customLogger2.LogOnError(err, "Fails on backfilling user history in database")
+		return nil, false, BackendError{Backend: BackendMongo, Err: err}
+	}
+	acc.customLogger.Println("Backfilled " + strconv.Itoa(rewritten) + " documents of user history")
+
+	backfilled, err := acc.config.Mongo.GetUserHistory(targetAddr)
+	if err != nil {
+		acc.customLogger2.LogOnError(err, "Fails on the request of cached user detailed transaction history")
+		return nil, false, BackendError{Backend: BackendMongo, Err: err}
+	}
+	return backfilled, true, nil
+}
+
 func removeStateKeyRedis(config *Config, key string) {
 	err := config.Redis.Del(key)
 	if err != nil {
-		logger.FailOnError(err, "Failed to remove key in redis: key => "+key)
+		logger.LogOnError(err, "Failed to remove key in redis: key => "+key)
 	}
 }
 
 // manipulateUserData processes raw data from database and btcd jsonRpc service as follows
 // it keeps data in database up to date by appending newly update instead of replacing the old one for consistency and performance improvement
-// it only appends data confirmed at least n 'confirmations' which is defined in 'account.go' to database
+// it only appends data confirmed more than 'RequiredConfirmations' of the config to database
+// unconfirmed transactions are summarized apart from the balance and never leave memory
 // otherwise, other data are always gathered from btcd and then merge them into data from database processing on-the-air for serving real-time data
-func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
+// it gives up fetching from btcd as soon as ctx is done
+func manipulateUserData(ctx context.Context, acc *account, targetAddr string) (*userData, error) {
 	key := utils.GenStateKey(targetAddr, rs.CommandAll)
-	defer removeStateKeyRedis(acc.config, key)
-	// pre-checks
-	state, err := acc.config.Redis.Get(key)
-	if err == redis.Nil {
-		acc.customLogger2.LogOnError(err, "Could not find key existing in redis: key => "+key)
-		return nil, err
-	}
-	if err != nil {
-		acc.customLogger2.LogOnError(err, "Fails on checking whether the key exists on redis: key => "+key)
-		return nil, err
+	state := rs.StateAlreadyExisting
+	var err error
+	if !acc.config.SkipStateKey {
+		defer removeStateKeyRedis(acc.config, key)
+		// pre-checks
+		state, err = acc.config.Redis.Get(key)
+		if err == redis.Nil {
+			acc.customLogger2.LogOnError(err, "Could not find key existing in redis: key => "+key)
+			return nil, StateKeyNotFoundError{Key: key}
+		}
+		if err != nil {
+			acc.customLogger2.LogOnError(err, "Fails on checking whether the key exists on redis: key => "+key)
+			return nil, BackendError{Backend: BackendRedis, Err: err}
+		}
 	}
 
 	subtotalAll := int64(0)
@@ -217,6 +668,7 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 	unspentAmtsAll := make(map[string]uint64, 0)
 	unspentsAll := make([]*mongo.Unspent, 0)
 	skipped := uint64(0)
+	detailsAll := make([]mongo.TxDetail, 0)
 
 	// predb
 	subtotalPreDB := int64(0)
@@ -242,7 +694,7 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 				fetchFromDB = true
 			} else {
 				acc.customLogger2.LogOnError(err, "Error occurred on the request of fetching cached data from redis")
-				return nil, err
+				return nil, BackendError{Backend: BackendRedis, Err: err}
 			}
 		}
 		elapsedTime = time.Since(startTime)
@@ -258,13 +710,44 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 					new = true
 				} else {
 					acc.customLogger2.LogOnError(err, "Fails on the request of cached user detailed transaction history")
-					return nil, err
+					return nil, BackendError{Backend: BackendMongo, Err: err}
 				}
 			}
 			elapsedTime = time.Since(startTime)
 			acc.customLogger.Println("Data accessed from database takes " + elapsedTime.String())
 		}
 
+		if !new {
+			startTime = time.Now()
+			var rolledBack bool
+			preDB, rolledBack, err = verifyUserHistory(acc, targetAddr, preDB)
+			if err != nil {
+				return nil, err
+			}
+			if rolledBack {
+				// cached data is rebuilt from what remains
+				fetchFromDB = true
+				new = preDB == nil
+			}
+			elapsedTime = time.Since(startTime)
+			acc.customLogger.Println("Verifying blocks of data from database/redis takes " + elapsedTime.String())
+		}
+
+		if !new {
+			startTime = time.Now()
+			var backfilled bool
+			preDB, backfilled, err = backfillUserHistory(ctx, acc, targetAddr, preDB)
+			if err != nil {
+				return nil, err
+			}
+			if backfilled {
+				// cached data is rebuilt from what is rewritten
+				fetchFromDB = true
+			}
+			elapsedTime = time.Since(startTime)
+			acc.customLogger.Println("Backfilling data from database/redis takes " + elapsedTime.String())
+		}
+
 		startTime = time.Now()
 		if !new {
 			subtotalPreDB = preDB.Subtotal
@@ -277,6 +760,7 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 			unspentsAll = referenceUnspents(preDB.Unspents)
 			// copy(unspentsPreDB, unspentsAll)
 			skipped = preDB.Skipped
+			detailsAll = append(detailsAll, preDB.Details...)
 			restoreSpentStates(spentsAll, preDB.Shadowspents)
 		}
 		elapsedTime = time.Since(startTime)
@@ -284,7 +768,9 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 	} else if state == rs.StateNew {
 		acc.customLogger.Println("New address detected... bypass query for database/redis")
 	} else {
-		acc.customLogger2.FailOnError(errors.New("Unknown state"), "Unsupported state on redis")
+		err := CorruptedDataError{Key: key, Reason: "Unsupported state " + state + " on redis"}
+		acc.customLogger2.LogOnError(err, "Unsupported state on redis")
+		return nil, err
 	}
 
 	// db, memory
@@ -301,13 +787,32 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 	// unspentsNonDB := make([]*mongo.Unspent, 0)
 	shadowSpentsDB := make([]string, 0)
 	subtotalDB := int64(0)
+	pendingTxs := make([]btcd.ResponseSearchRawTransactions, 0)
+	blocksDB := make([]mongo.Block, 0)
+	detailsDB := make([]mongo.TxDetail, 0)
+	// tip is the height of the best block which confirmations of the page fetched are counted from
+	tip := uint64(0)
+	confirmations := make(map[string]uint64, 0)
+	spenders := make(map[string]string, 0)
+	spendersDB := make(map[string]string, 0)
+	if preDB != nil {
+		for key, val := range preDB.Spenders {
+			spenders[key] = val
+		}
+	}
 
 	// process non db part and memory part
 	startTime2 := time.Now()
 	start := int64(skipped)
 	for !alldone {
+		if err := ctx.Err(); err != nil {
+			acc.customLogger2.LogOnError(err, "Gives up the request of user detailed transaction history")
+			return nil, err
+		}
+
 		startTime = time.Now()
-		res, err := node.SearchRawTransactions(targetAddr, start, maxRequestedTransactionsRecord)
+		var res *[]btcd.ResponseSearchRawTransactions
+		res, tip, err = searchTransactions(node, targetAddr, start, tip, acc.config.RequiredConfirmations)
 		elapsedTime = time.Since(startTime)
 		acc.customLogger.Println("Fetching data from btcd takes " + elapsedTime.String())
 		if err != nil {
@@ -315,7 +820,7 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 				break
 			}
 			acc.customLogger2.LogOnError(err, "Fails on the request of user detailed transaction history")
-			return nil, err
+			return nil, BackendError{Backend: BackendBtcd, Err: err}
 		}
 
 		txsLen := len(*res)
@@ -327,16 +832,29 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 			blocktime := tx.Blocktime
 			cfms := tx.Confirmations // confirmations of the transaction
 			if cfms == 0 {
-				continue // skip all unconfirmed transactions
+				// unconfirmed transactions are left out of the balance
+				pendingTxs = append(pendingTxs, tx)
+				continue
 			}
 
+			confirmations[tx.Txid] = cfms
+			// height is known for transactions stored only, the others are derived from confirmations on demand
+			height := uint64(0)
+			received := uint64(0)
+			sent := uint64(0)
 			persistent := false
-			if cfms > requiredConfirmations {
+			if cfms > acc.config.RequiredConfirmations {
 				persistent = true
 			}
 
 			if persistent {
+				height = heightOf(tx, tip)
 				transactionsDB = append(transactionsDB, tx.Txid)
+				blocksDB = append(blocksDB, mongo.Block{
+					Transaction: tx.Txid,
+					Hash:        tx.Blockhash,
+					Height:      height,
+				})
 			}
 			// } else {
 			// transactionsNonDB = append(transactionsNonDB, tx.Txid)
@@ -376,6 +894,7 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 						spentsNonDB[key] = &spent
 					}
 					subtotalAll += amt
+					received += unspent.Amount
 					unspentAmtsAll[key] = unspent.Amount
 					unspentsAll = append(unspentsAll, &unspent)
 					spentsAll[key] = &spent
@@ -386,6 +905,11 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 				if containsAddr(vin.PrevOut.Addresses, targetAddr) {
 					key := vin.Txid + "+" + strconv.FormatUint(vin.VoutIndex, 10)
 					amt := int64(unspentAmtsAll[key])
+					spenders[key] = tx.Txid
+					if persistent {
+						spendersDB[key] = tx.Txid
+					}
+					sent += uint64(amt)
 					var spent *bool
 					var ok bool
 					if persistent {
@@ -393,14 +917,14 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 						if !ok {
 							spent, ok = spentsDB[key]
 							if !ok {
-								err := errors.New("Cannot find key " + key + " on 'spentsPreDB/spentsDB'")
+								err := CorruptedDataError{Key: key, Reason: "Cannot find key on 'spentsPreDB/spentsDB'"}
 								acc.customLogger2.LogOnError(err, "Should exist this unspent key on 'spentsPreDB/spentsDB'. Corrupted database?")
 								return nil, err
 							}
 
 							spentPersistent, ok := spentsDBPersistent[key]
 							if ok && spentPersistent {
-								err := errors.New("Double spent at key: " + key)
+								err := CorruptedDataError{Key: key, Reason: "Double spent"}
 								acc.customLogger2.LogOnError(err, "Should not spend spent fund! Corrupted database?")
 								return nil, err
 							}
@@ -416,7 +940,7 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 							if !ok {
 								spent, ok = spentsNonDB[key]
 								if !ok {
-									err := errors.New("Cannot find key " + key + " on 'spentsPreDB/spentsDB/spentsNonDB'")
+									err := CorruptedDataError{Key: key, Reason: "Cannot find key on 'spentsPreDB/spentsDB/spentsNonDB'"}
 									acc.customLogger2.LogOnError(err, "Should exist this unspent key on 'spentsPreDB/spentsDB/spentsNonDB'. Corrupted database?")
 									return nil, err
 								}
@@ -424,7 +948,7 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 						}
 					}
 					if *spent {
-						err := errors.New("Double spent at key: " + key)
+						err := CorruptedDataError{Key: key, Reason: "Double spent"}
 						acc.customLogger2.LogOnError(err, "Should not spend spent fund! Corrupted database?")
 						return nil, err
 					}
@@ -432,6 +956,18 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 					subtotalAll -= amt
 				}
 			}
+
+			detail := mongo.TxDetail{
+				Transaction: tx.Txid,
+				BlockTime:   blocktime,
+				Height:      height,
+				Received:    received,
+				Sent:        sent,
+			}
+			if persistent {
+				detailsDB = append(detailsDB, detail)
+			}
+			detailsAll = append(detailsAll, detail)
 		}
 
 		if txsLen < maxRequestedTransactionsRecord {
@@ -446,10 +982,11 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 	skipped = uint64(len(transactionsDB) + len(transactionsPreDB))
 
 	var usrHistory *mongo.UserHistory
-	if len(transactionsDB) != 0 || fetchFromDB {
+	// nothing is cached for addresses without history in database
+	if len(transactionsDB) != 0 || (fetchFromDB && preDB != nil) {
 		if len(transactionsDB) != 0 {
 			startTime = time.Now()
-			usrHistory = createUserHistory(targetAddr, unspentsDB, unspentAmtsDB, spentsDBPersistent, shadowSpentsDB, transactionsDB, skipped, subtotalDB)
+			usrHistory = createUserHistory(targetAddr, unspentsDB, unspentAmtsDB, spentsDBPersistent, shadowSpentsDB, transactionsDB, skipped, subtotalDB, blocksDB, detailsDB, spendersDB)
 			elapsedTime = time.Since(startTime)
 			acc.customLogger.Println("The task requested to prepare for UserHistory takes " + elapsedTime.String())
 
@@ -459,7 +996,7 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 			acc.customLogger.Println("Document creation on database takes " + elapsedTime.String())
 			if err != nil {
 				acc.customLogger2.LogOnError(err, "Fails on the document creation in database")
-				return nil, err
+				return nil, BackendError{Backend: BackendMongo, Err: err}
 			}
 		} else {
 			acc.customLogger.Println("No need to create/update document on database")
@@ -480,31 +1017,139 @@ func manipulateUserData(acc *account, targetAddr string) (*userData, error) {
 		err = rsmgo.CacheUserHistory(acc.config.Redis, key, cachedUsrHistory, 3600*time.Second)
 		if err != nil {
 			acc.customLogger2.LogOnError(err, "Fails on updating cached data on redis... trying to remove cached data on redis")
-			err = acc.config.Redis.Del(key)
-			if err != nil {
+			if err := acc.config.Redis.Del(key); err != nil {
 				acc.customLogger2.LogOnError(err, "Fails on removing cached data on redis")
-				return nil, err
 			}
-			return nil, err
+			return nil, BackendError{Backend: BackendRedis, Err: err}
 		}
 		acc.customLogger.Println("The creation of cached data on redis takes " + elapsedTime.String())
 	}
 
+	pending, unconfirmed := summarizePending(acc.customLogger, targetAddr, pendingTxs, unspentAmtsAll)
 	res := userData{
-		Unspents:     unspentsAll,
-		Spents:       spentsAll,
-		Transactions: transactionsAll,
-		Total:        subtotalAll,
+		Unspents:      unspentsAll,
+		Spents:        spentsAll,
+		Transactions:  transactionsAll,
+		Total:         subtotalAll,
+		Unconfirmed:   unconfirmed,
+		Pending:       pending,
+		Confirmations: confirmations,
+		Spenders:      spenders,
+		Details:       detailsAll,
 	}
 	return &res, nil
 }
 
+// confirmedView narrows user data down to transactions confirmed at least minConfirmations times
+// The others are listed as pending along with their changes of the balance moved to Unconfirmed
+// Confirmations of transactions restored from database/redis are derived from their heights and the tip,
+// which is given only if minConfirmations exceeds those required to store them. Legacy ones without heights are kept
+func confirmedView(uData *userData, minConfirmations uint64, tip uint64) *userData {
+	if minConfirmations <= 1 {
+		return uData
+	}
+
+	storedConfirmations := make(map[string]uint64, 0)
+	if tip != 0 {
+		for _, detail := range uData.Details {
+			if _, ok := uData.Confirmations[detail.Transaction]; !ok && detail.Height != 0 && detail.Height <= tip {
+				storedConfirmations[detail.Transaction] = tip + 1 - detail.Height
+			}
+		}
+	}
+	shallow := func(txid string) bool {
+		cfms, ok := uData.Confirmations[txid]
+		if !ok {
+			cfms, ok = storedConfirmations[txid]
+		}
+		return ok && cfms < minConfirmations
+	}
+
+	view := *uData
+	view.Transactions = make([]string, 0)
+	for _, txid := range uData.Transactions {
+		if !shallow(txid) {
+			view.Transactions = append(view.Transactions, txid)
+		}
+	}
+
+	view.Pending = Pending{
+		Incoming: append([]string{}, uData.Pending.Incoming...),
+		Outgoing: append([]string{}, uData.Pending.Outgoing...),
+	}
+	view.Details = make([]mongo.TxDetail, 0)
+	for _, detail := range uData.Details {
+		if !shallow(detail.Transaction) {
+			view.Details = append(view.Details, detail)
+			continue
+		}
+		if detail.Sent > 0 {
+			view.Pending.Outgoing = append(view.Pending.Outgoing, detail.Transaction)
+		} else {
+			view.Pending.Incoming = append(view.Pending.Incoming, detail.Transaction)
+		}
+	}
+
+	view.Unspents = make([]*mongo.Unspent, 0)
+	view.Spents = make(map[string]*bool, 0)
+	view.Total = 0
+	for _, unspt := range uData.Unspents {
+		if shallow(unspt.Transaction) {
+			continue
+		}
+		key := unspt.Transaction + "+" + strconv.FormatUint(unspt.VOutIdx, 10)
+		spent := false
+		if spt, ok := uData.Spents[key]; ok {
+			spent = *spt
+		}
+		if spender, ok := uData.Spenders[key]; ok && shallow(spender) {
+			spent = false
+		}
+		view.Unspents = append(view.Unspents, unspt)
+		view.Spents[key] = &spent
+		if !spent {
+			view.Total += int64(unspt.Amount)
+		}
+	}
+	view.Unconfirmed = uData.Unconfirmed + uData.Total - view.Total
+	return &view
+}
+
+// fetchUserData manipulates user data for the address, joining the in-flight one requested by others if any
+// The result is narrowed down to transactions confirmed at least minConfirmations times, where 0 is taken as 1
+func fetchUserData(ctx context.Context, acc *account, addr string, minConfirmations uint64) (*userData, error) {
+	uData, shared, err := inflight.do(ctx, flightKey{addr, acc.config.SkipStateKey}, func(flightCtx context.Context) (*userData, error) {
+		return manipulateUserData(flightCtx, acc, addr)
+	})
+	if shared {
+		acc.customLogger.Println("Shared the result of in-flight manipulation of user data: addr => " + addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tip := uint64(0)
+	if minConfirmations > acc.config.RequiredConfirmations+1 {
+		// stored transactions might be confirmed fewer times than requested
+		tip, err = tipHeight(acc.config.Btcd)
+		if err != nil {
+			acc.customLogger2.LogOnError(err, "Fails on the request of block height")
+			return nil, BackendError{Backend: BackendBtcd, Err: err}
+		}
+	}
+	return confirmedView(uData, minConfirmations, tip), nil
+}
+
 // Account provides worker with all account relevant information
 type Account interface {
-	GetAddressBalance(addr string) (float64, error)
-	GetAddressTransactions(addr string) ([]string, error)
-	GetAddressUnspentOutputs(addr string) ([]*mongo.Unspent, error)
-	GetAddressResult(addr string) (*UserData, error)
+	GetAddressBalance(ctx context.Context, addr string) (float64, error)
+	GetAddressBalanceDetail(ctx context.Context, addr string, minConfirmations uint64) (*BalanceDetail, error)
+	GetAddressTransactions(ctx context.Context, addr string, minConfirmations uint64) ([]string, error)
+	GetAddressUnspentOutputs(ctx context.Context, addr string, minConfirmations uint64) ([]*mongo.Unspent, error)
+	GetAddressResult(ctx context.Context, addr string, minConfirmations uint64) (*UserData, error)
+	GetAddressHistory(ctx context.Context, addr string, minConfirmations uint64) ([]HistoryEntry, error)
+	GetAddressBalanceAt(ctx context.Context, addr string, point Point) (*HistoricalBalance, error)
+	GetAddressBalanceSeries(ctx context.Context, addr string, interval string, from time.Time, to time.Time) ([]BalancePoint, error)
 }
 
 type account struct {
@@ -514,17 +1159,34 @@ type account struct {
 }
 
 // GetAddressBalance returns the balance of the given account
-func (acc *account) GetAddressBalance(addr string) (float64, error) {
-	uData, err := manipulateUserData(acc, addr)
+func (acc *account) GetAddressBalance(ctx context.Context, addr string) (float64, error) {
+	uData, err := fetchUserData(ctx, acc, addr, 0)
 	if err != nil {
 		return 0, err
 	}
 	return float64(uData.Total) / float64(satoshi), nil
 }
 
+// GetAddressBalanceDetail returns the exact balance of the given account split by confirmation
+func (acc *account) GetAddressBalanceDetail(ctx context.Context, addr string, minConfirmations uint64) (*BalanceDetail, error) {
+	uData, err := fetchUserData(ctx, acc, addr, minConfirmations)
+	if err != nil {
+		return nil, err
+	}
+	return newBalanceDetail(uData), nil
+}
+
+func newBalanceDetail(uData *userData) *BalanceDetail {
+	return &BalanceDetail{
+		Confirmed:   uData.Total,
+		Unconfirmed: uData.Unconfirmed,
+		Pending:     uData.Pending,
+	}
+}
+
 // GetAddressTransactions returns the list of transaction ids with the given account
-func (acc *account) GetAddressTransactions(addr string) ([]string, error) {
-	uData, err := manipulateUserData(acc, addr)
+func (acc *account) GetAddressTransactions(ctx context.Context, addr string, minConfirmations uint64) ([]string, error) {
+	uData, err := fetchUserData(ctx, acc, addr, minConfirmations)
 	if err != nil {
 		return nil, err
 	}
@@ -532,8 +1194,8 @@ func (acc *account) GetAddressTransactions(addr string) ([]string, error) {
 }
 
 // GetAddressUnspentOutputs returns the unspent outputs of the given account
-func (acc *account) GetAddressUnspentOutputs(addr string) ([]*mongo.Unspent, error) {
-	uData, err := manipulateUserData(acc, addr)
+func (acc *account) GetAddressUnspentOutputs(ctx context.Context, addr string, minConfirmations uint64) ([]*mongo.Unspent, error) {
+	uData, err := fetchUserData(ctx, acc, addr, minConfirmations)
 	if err != nil {
 		return nil, err
 	}
@@ -543,8 +1205,8 @@ func (acc *account) GetAddressUnspentOutputs(addr string) ([]*mongo.Unspent, err
 }
 
 // GetAddressResult returns details for the given address
-func (acc *account) GetAddressResult(addr string) (*UserData, error) {
-	uData, err := manipulateUserData(acc, addr)
+func (acc *account) GetAddressResult(ctx context.Context, addr string, minConfirmations uint64) (*UserData, error) {
+	uData, err := fetchUserData(ctx, acc, addr, minConfirmations)
 	if err != nil {
 		return nil, err
 	}
@@ -555,14 +1217,242 @@ func (acc *account) GetAddressResult(addr string) (*UserData, error) {
 		_unspents = append(_unspents, *val)
 	}
 
+	detail := newBalanceDetail(uData)
 	res := UserData{
 		Balance:      float64(uData.Total) / float64(satoshi),
 		Transactions: uData.Transactions,
 		Unspents:     _unspents,
+		Confirmed:    float64(uData.Total) / float64(satoshi),
+		Unconfirmed:  float64(uData.Unconfirmed) / float64(satoshi),
+		Pending:      uData.Pending,
+		detail:       *detail,
+	}
+	return &res, nil
+}
+
+// GetAddressHistory returns details of transactions with the given account in the same order as transactions
+func (acc *account) GetAddressHistory(ctx context.Context, addr string, minConfirmations uint64) ([]HistoryEntry, error) {
+	uData, err := fetchUserData(ctx, acc, addr, minConfirmations)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]HistoryEntry, 0)
+	if len(uData.Transactions) == 0 {
+		return history, nil
+	}
+	details := make(map[string]mongo.TxDetail, 0)
+	for _, detail := range uData.Details {
+		details[detail.Transaction] = detail
+	}
+	tip, err := tipHeight(acc.config.Btcd)
+	if err != nil {
+		acc.customLogger2.LogOnError(err, "Fails on the request of block height")
+		return nil, BackendError{Backend: BackendBtcd, Err: err}
+	}
+
+	for _, txid := range uData.Transactions {
+		detail, ok := details[txid]
+		if !ok {
+			return nil, IncompleteHistoryError{Key: txid}
+		}
+		height, cfms := resolveBlock(detail, uData.Confirmations, tip)
+		history = append(history, HistoryEntry{
+			Transaction:   detail.Transaction,
+			BlockTime:     detail.BlockTime,
+			Height:        height,
+			Confirmations: cfms,
+			Received:      int64(detail.Received),
+			Sent:          int64(detail.Sent),
+			Net:           int64(detail.Received) - int64(detail.Sent),
+		})
+	}
+	return history, nil
+}
+
+// GetAddressBalanceAt replays outputs of the given account and spends of them up to the point, both inclusive,
+// and returns the confirmed balance with unspent outputs as of then
+// Outputs are placed by their block time or by height of the transaction, spends by details of spending transactions
+func (acc *account) GetAddressBalanceAt(ctx context.Context, addr string, point Point) (*HistoricalBalance, error) {
+	uData, err := fetchUserData(ctx, acc, addr, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	byTime := !point.Time.IsZero()
+	at := uint64(point.Time.Unix())
+	details := make(map[string]mongo.TxDetail, 0)
+	tipNeeded := false
+	for _, detail := range uData.Details {
+		details[detail.Transaction] = detail
+		if detail.Height == 0 {
+			tipNeeded = true
+		}
+	}
+	tip := uint64(0)
+	if !byTime && tipNeeded {
+		tip, err = tipHeight(acc.config.Btcd)
+		if err != nil {
+			acc.customLogger2.LogOnError(err, "Fails on the request of block height")
+			return nil, BackendError{Backend: BackendBtcd, Err: err}
+		}
+	}
+
+	// reached tells whether the transaction is confirmed by the point
+	reached := func(txid string) (bool, error) {
+		detail, ok := details[txid]
+		if !ok {
+			return false, IncompleteHistoryError{Key: txid}
+		}
+		if byTime {
+			return detail.BlockTime <= at, nil
+		}
+		height, _ := resolveBlock(detail, uData.Confirmations, tip)
+		return height <= point.Height, nil
+	}
+
+	res := HistoricalBalance{
+		Unspents: make([]mongo.Unspent, 0),
+	}
+	for _, unspt := range uData.Unspents {
+		created := unspt.BlockTime <= at
+		if !byTime {
+			created, err = reached(unspt.Transaction)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !created {
+			continue
+		}
+
+		key := unspt.Transaction + "+" + strconv.FormatUint(unspt.VOutIdx, 10)
+		if spent, ok := uData.Spents[key]; ok && *spent {
+			spender, ok := uData.Spenders[key]
+			if !ok {
+				return nil, IncompleteHistoryError{Key: key}
+			}
+			spentThen, err := reached(spender)
+			if err != nil {
+				return nil, err
+			}
+			if spentThen {
+				continue
+			}
+		}
+		res.Balance += int64(unspt.Amount)
+		res.Unspents = append(res.Unspents, *unspt)
 	}
 	return &res, nil
 }
 
+// GetAddressBalanceSeries returns the confirmed balance of the given account over time from details of transactions
+// Points are taken after every transaction or at the last second of every day/month in UTC, all of which lie
+// between from and to, both inclusive. The period in progress at to closes at to
+// Zero from starts at the first transaction, while zero to ends at the last transaction for interval 'tx', otherwise now
+// Series longer than MaxSeriesPoints of the config are rejected
+func (acc *account) GetAddressBalanceSeries(ctx context.Context, addr string, interval string, from time.Time, to time.Time) ([]BalancePoint, error) {
+	uData, err := fetchUserData(ctx, acc, addr, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	details := make(map[string]mongo.TxDetail, 0)
+	for _, detail := range uData.Details {
+		details[detail.Transaction] = detail
+	}
+	// balances after every transaction in the order of transactions
+	steps := make([]BalancePoint, 0)
+	balance := int64(0)
+	for _, txid := range uData.Transactions {
+		detail, ok := details[txid]
+		if !ok {
+			return nil, IncompleteHistoryError{Key: txid}
+		}
+		balance += int64(detail.Received) - int64(detail.Sent)
+		steps = append(steps, BalancePoint{
+			Time:        time.Unix(int64(detail.BlockTime), 0).UTC(),
+			Transaction: txid,
+			Balance:     balance,
+		})
+	}
+
+	max := acc.config.MaxSeriesPoints
+	series := make([]BalancePoint, 0)
+	if interval == IntervalTransaction {
+		for _, step := range steps {
+			if (from.IsZero() || !step.Time.Before(from)) && (to.IsZero() || !step.Time.After(to)) {
+				if max > 0 && len(series) == max {
+					return nil, TooManyPointsError{Max: max}
+				}
+				series = append(series, step)
+			}
+		}
+		return series, nil
+	}
+
+	if from.IsZero() {
+		if len(steps) == 0 {
+			return series, nil
+		}
+		from = steps[0].Time
+	}
+	if now := time.Now(); to.IsZero() || to.After(now) {
+		to = now
+	}
+	from = from.UTC()
+	to = to.UTC()
+	next := func(t time.Time) time.Time {
+		if interval == IntervalMonth {
+			return t.AddDate(0, 1, 0)
+		}
+		return t.AddDate(0, 0, 1)
+	}
+
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	if interval == IntervalMonth {
+		start = time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	idx := 0
+	balance = 0
+	for period := start; !period.After(to); period = next(period) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if max > 0 && len(series) == max {
+			return nil, TooManyPointsError{Max: max}
+		}
+		// block times are in seconds, so that the last second closes the period
+		closing := next(period).Add(-time.Second)
+		if closing.After(to) {
+			closing = to
+		}
+		for idx < len(steps) && !steps[idx].Time.After(closing) {
+			balance = steps[idx].Balance
+			idx++
+		}
+		series = append(series, BalancePoint{
+			Time:    closing,
+			Balance: balance,
+		})
+	}
+	return series, nil
+}
+
+// resolveBlock returns height and confirmations of the transaction
+// Heights of transactions not stored and confirmations of those stored are derived from the tip
+func resolveBlock(detail mongo.TxDetail, confirmations map[string]uint64, tip uint64) (uint64, uint64) {
+	height := detail.Height
+	cfms, ok := confirmations[detail.Transaction]
+	if !ok && height <= tip {
+		cfms = tip + 1 - height
+	}
+	if height == 0 && cfms <= tip+1 {
+		height = tip + 1 - cfms
+	}
+	return height, cfms
+}
+
 // New creates an instance of Account
 func New(customLogger *log.Logger, customLogger2 logger.CustomLogger, config *Config) Account {
 	return &account{
@@ -1,11 +1,15 @@
 package account_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/golang/mock/gomock"
 	gomark "github.com/golang/mock/gomock"
 	"github.com/junzhli/btcd-address-indexing-worker/account"
@@ -412,6 +416,7 @@ func initMocks(env *vars) {
 	var txHistory []btcd.ResponseSearchRawTransactions
 	json.Unmarshal([]byte(rawTxs), &txHistory)
 	firstCall := env.btcd.EXPECT().SearchRawTransactions(address, int64(0), int64(2000)).Return(&txHistory, nil).Times(1)
+	env.btcd.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(602288)}, nil).AnyTimes()
 	secondCall := env.mongo.EXPECT().PutUserHistory(gomock.Any()).Return(nil).Times(1).After(firstCall)
 	cacheKey := utils.GenCacheKey(address, rs.CommandAll)
 	thirdCall := env.redis.EXPECT().Set(cacheKey, gomock.Any(), gomock.Any()).Return(nil).Times(1).After(secondCall)
@@ -422,7 +427,7 @@ func TestAccountGetBalance(t *testing.T) {
 	v := initVars(t)
 	initMocks(&v)
 
-	balance, err := v.account.GetAddressBalance(address)
+	balance, err := v.account.GetAddressBalance(context.Background(), address)
 	if err != nil {
 		t.Fail()
 		return
@@ -437,7 +442,7 @@ func TestAccountGetTransactions(t *testing.T) {
 	v := initVars(t)
 	initMocks(&v)
 
-	txs, err := v.account.GetAddressTransactions(address)
+	txs, err := v.account.GetAddressTransactions(context.Background(), address, 0)
 	if err != nil {
 		t.Fail()
 		return
@@ -460,7 +465,7 @@ func TestAccountGetUnspents(t *testing.T) {
 	v := initVars(t)
 	initMocks(&v)
 
-	outputs, err := v.account.GetAddressUnspentOutputs(address)
+	outputs, err := v.account.GetAddressUnspentOutputs(context.Background(), address, 0)
 	if err != nil {
 		t.Fail()
 		return
@@ -479,3 +484,293 @@ func TestAccountGetUnspents(t *testing.T) {
 		return
 	}
 }
+
+func TestAccountStateKeyNotFound(t *testing.T) {
+	v := initVars(t)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	v.redis.EXPECT().Get(stateKey).Return("", redis.Nil).Times(1)
+	v.redis.EXPECT().Del(stateKey).Return(nil).Times(1)
+
+	_, err := v.account.GetAddressBalance(context.Background(), address)
+	if _, ok := err.(account.StateKeyNotFoundError); !ok {
+		t.Fail()
+	}
+}
+
+func TestAccountDeadlineExceeded(t *testing.T) {
+	v := initVars(t)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	v.redis.EXPECT().Get(stateKey).Return(rs.StateNew, nil).Times(1)
+	v.redis.EXPECT().Del(stateKey).Return(nil).Times(1)
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err := v.account.GetAddressBalance(ctx, address)
+	if err != context.DeadlineExceeded {
+		t.Fail()
+	}
+}
+
+func TestAccountRollbackOnReorg(t *testing.T) {
+	v := initVars(t)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	cacheKey := utils.GenCacheKey(address, rs.CommandAll)
+	orphaned := mongo.Block{Transaction: "phantom", Hash: "orphaned", Height: 602280}
+	stable := mongo.Block{Transaction: "5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d", Hash: "stable", Height: 500000}
+	history := &mongo.UserHistory{
+		Address:      address,
+		Subtotal:     100000000,
+		Spents:       map[string]bool{"phantom+0": false},
+		UnspentAmts:  map[string]uint64{"phantom+0": 100000000},
+		Unspents:     []mongo.Unspent{{Transaction: "phantom", Amount: 100000000}},
+		Transactions: []string{"phantom"},
+		Skipped:      1,
+		Blocks:       []mongo.Block{stable, orphaned},
+	}
+
+	v.redis.EXPECT().Get(stateKey).Return(rs.StateAlreadyExisting, nil).Times(1)
+	v.redis.EXPECT().Get(cacheKey).Return("", redis.Nil).Times(1)
+	v.mongo.EXPECT().GetUserHistory(address).Return(history, nil).Times(1)
+	v.btcd.EXPECT().GetBestBlockHash().Return("tip", nil).Times(1)
+	// the orphaned block is kept on a side chain, whose height is taken by another block on the main chain
+	v.btcd.EXPECT().GetBlockHash(uint64(602280)).Return("replacement", nil).Times(1)
+	v.btcd.EXPECT().GetBlockHash(uint64(500000)).Return("stable", nil).Times(1)
+	v.mongo.EXPECT().RollbackUserHistory(address, uint64(602280)).Return(1, nil).Times(1)
+	v.redis.EXPECT().Del(cacheKey).Return(nil).Times(1)
+	v.mongo.EXPECT().GetUserHistory(address).Return(nil, errors.New(mongo.ErrorNoUserInfo)).Times(1)
+	v.btcd.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(602288)}, nil).Times(1)
+	v.btcd.EXPECT().SearchRawTransactions(address, int64(0), int64(2000)).Return(nil, errors.New(btcd.ErrorNoDataReturned)).Times(1)
+	v.redis.EXPECT().Del(stateKey).Return(nil).Times(1)
+
+	balance, err := v.account.GetAddressBalance(context.Background(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 0 {
+		t.Errorf("Expected phantom balance rolled back, got %v", balance)
+	}
+}
+
+func TestAccountVerifyUnchangedTip(t *testing.T) {
+	v := initVars(t)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	cacheKey := utils.GenCacheKey(address, rs.CommandAll)
+	history := &mongo.UserHistory{
+		Address:      address,
+		Transactions: []string{"oldest", "older", "newest"},
+		Skipped:      3,
+		Blocks: []mongo.Block{
+			{Transaction: "oldest", Hash: "oldest", Height: 500000},
+			{Transaction: "older", Hash: "older", Height: 550000},
+			{Transaction: "newest", Hash: "newest", Height: 600000},
+		},
+		Details: []mongo.TxDetail{
+			{Transaction: "oldest", Height: 500000},
+			{Transaction: "older", Height: 550000},
+			{Transaction: "newest", Height: 600000},
+		},
+	}
+
+	v.redis.EXPECT().Get(stateKey).Return(rs.StateAlreadyExisting, nil).Times(2)
+	v.redis.EXPECT().Get(cacheKey).Return("", redis.Nil).Times(2)
+	v.mongo.EXPECT().GetUserHistory(address).Return(history, nil).Times(2)
+	v.btcd.EXPECT().GetBestBlockHash().Return("unchanged", nil).Times(2)
+	// the newest block is checked once while the best block is unchanged
+	v.btcd.EXPECT().GetBlockHash(uint64(600000)).Return("newest", nil).Times(1)
+	v.btcd.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(602288)}, nil).Times(2)
+	v.btcd.EXPECT().SearchRawTransactions(address, int64(3), int64(2000)).Return(nil, errors.New(btcd.ErrorNoDataReturned)).Times(2)
+	v.redis.EXPECT().Set(cacheKey, gomock.Any(), gomock.Any()).Return(nil).Times(2)
+	v.redis.EXPECT().Del(stateKey).Return(nil).Times(2)
+
+	for i := 0; i < 2; i++ {
+		if _, err := v.account.GetAddressBalance(context.Background(), address); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAccountMinConfirmationsStored(t *testing.T) {
+	v := initVars(t)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	cacheKey := utils.GenCacheKey(address, rs.CommandAll)
+	history := &mongo.UserHistory{
+		Address:      address,
+		Subtotal:     200000000,
+		Spents:       map[string]bool{"deep+0": false, "recent+0": false},
+		UnspentAmts:  map[string]uint64{"deep+0": 100000000, "recent+0": 100000000},
+		Unspents:     []mongo.Unspent{{Transaction: "deep", Amount: 100000000}, {Transaction: "recent", Amount: 100000000}},
+		Transactions: []string{"deep", "recent"},
+		Skipped:      2,
+		Details: []mongo.TxDetail{
+			{Transaction: "deep", Height: 500000, Received: 100000000},
+			{Transaction: "recent", Height: 601000, Received: 100000000},
+		},
+	}
+
+	v.redis.EXPECT().Get(stateKey).Return(rs.StateAlreadyExisting, nil).Times(1)
+	v.redis.EXPECT().Get(cacheKey).Return("", redis.Nil).Times(1)
+	v.mongo.EXPECT().GetUserHistory(address).Return(history, nil).Times(1)
+	v.btcd.EXPECT().SearchRawTransactions(address, int64(2), int64(2000)).Return(nil, errors.New(btcd.ErrorNoDataReturned)).Times(1)
+	v.redis.EXPECT().Set(cacheKey, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+	v.redis.EXPECT().Del(stateKey).Return(nil).Times(1)
+	v.btcd.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(602288)}, nil).Times(2)
+
+	// the recent one is confirmed 1289 times
+	detail, err := v.account.GetAddressBalanceDetail(context.Background(), address, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.Confirmed != 100000000 || detail.Unconfirmed != 100000000 ||
+		len(detail.Pending.Incoming) != 1 || detail.Pending.Incoming[0] != "recent" || len(detail.Pending.Outgoing) != 0 {
+		t.Errorf("Expected the recent transaction taken as pending, got %+v", detail)
+	}
+}
+
+func TestAccountBackfillLegacyHistory(t *testing.T) {
+	v := initVars(t)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	cacheKey := utils.GenCacheKey(address, rs.CommandAll)
+	// stored before blocks, details and spenders are recorded
+	legacy := &mongo.UserHistory{
+		Address:      address,
+		Spents:       map[string]bool{"funding+0": true},
+		UnspentAmts:  map[string]uint64{"funding+0": 100000000},
+		Unspents:     []mongo.Unspent{{Transaction: "funding", Amount: 100000000, BlockTime: 1540000000}},
+		Transactions: []string{"funding", "spending"},
+		Skipped:      2,
+	}
+	rawTxs := `[
+		{"txid": "funding", "vin": [], "vout": [{"value": 1, "scriptPubKey": {"addresses": ["` + address + `"]}}], "blockhash": "legacy", "confirmations": 102289, "blocktime": 1540000000},
+		{"txid": "spending", "vin": [{"txid": "funding", "vout": 0, "prevOut": {"addresses": ["` + address + `"]}}], "vout": [], "blockhash": "legacy", "confirmations": 102289, "blocktime": 1540000000}
+	]`
+	var txs []btcd.ResponseSearchRawTransactions
+	if err := json.Unmarshal([]byte(rawTxs), &txs); err != nil {
+		t.Fatal(err)
+	}
+	details := []mongo.TxDetail{
+		{Transaction: "funding", BlockTime: 1540000000, Height: 500000, Received: 100000000},
+		{Transaction: "spending", BlockTime: 1540000000, Height: 500000, Sent: 100000000},
+	}
+	backfilled := *legacy
+	backfilled.Blocks = []mongo.Block{{Transaction: "funding", Hash: "legacy", Height: 500000}, {Transaction: "spending", Hash: "legacy", Height: 500000}}
+	backfilled.Details = details
+	backfilled.Spenders = map[string]string{"funding+0": "spending"}
+	backfilled.Backfilled = true
+
+	v.redis.EXPECT().Get(stateKey).Return(rs.StateAlreadyExisting, nil).Times(1)
+	v.redis.EXPECT().Get(cacheKey).Return("", redis.Nil).Times(1)
+	v.mongo.EXPECT().GetUserHistory(address).Return(legacy, nil).Times(1)
+	v.btcd.EXPECT().SearchRawTransactions(address, int64(0), int64(2000)).Return(&txs, nil).Times(1)
+	v.mongo.EXPECT().BackfillUserHistory(address, backfilled.Blocks, details, backfilled.Spenders).Return(1, nil).Times(1)
+	v.mongo.EXPECT().GetUserHistory(address).Return(&backfilled, nil).Times(1)
+	v.btcd.EXPECT().SearchRawTransactions(address, int64(2), int64(2000)).Return(nil, errors.New(btcd.ErrorNoDataReturned)).Times(1)
+	v.redis.EXPECT().Set(cacheKey, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+	v.redis.EXPECT().Del(stateKey).Return(nil).Times(1)
+	v.btcd.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(602288)}, nil).AnyTimes()
+
+	history, err := v.account.GetAddressHistory(context.Background(), address, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Net != 100000000 || history[1].Net != -100000000 || history[1].Confirmations != 102289 {
+		t.Errorf("Expected legacy transactions backfilled, got %+v", history)
+	}
+}
+
+func TestAccountRollbackShortenedChain(t *testing.T) {
+	v := initVars(t)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	cacheKey := utils.GenCacheKey(address, rs.CommandAll)
+	history := &mongo.UserHistory{
+		Address:      address,
+		Subtotal:     100000000,
+		Spents:       map[string]bool{"phantom+0": false},
+		UnspentAmts:  map[string]uint64{"phantom+0": 100000000},
+		Unspents:     []mongo.Unspent{{Transaction: "phantom", Amount: 100000000}},
+		Transactions: []string{"phantom"},
+		Skipped:      1,
+		Blocks:       []mongo.Block{{Transaction: "phantom", Hash: "orphaned", Height: 602290}},
+		Details:      []mongo.TxDetail{{Transaction: "phantom", Height: 602290, Received: 100000000}},
+	}
+
+	v.redis.EXPECT().Get(stateKey).Return(rs.StateAlreadyExisting, nil).Times(1)
+	v.redis.EXPECT().Get(cacheKey).Return("", redis.Nil).Times(1)
+	v.mongo.EXPECT().GetUserHistory(address).Return(history, nil).Times(1)
+	v.btcd.EXPECT().GetBestBlockHash().Return("tip", nil).Times(1)
+	// the main chain is shorter than the block after reorganization
+	v.btcd.EXPECT().GetBlockHash(uint64(602290)).Return("", errors.New(btcd.ErrorBlockHeightOutOfRange)).Times(1)
+	v.mongo.EXPECT().RollbackUserHistory(address, uint64(0)).Return(1, nil).Times(1)
+	v.redis.EXPECT().Del(cacheKey).Return(nil).Times(1)
+	v.mongo.EXPECT().GetUserHistory(address).Return(nil, errors.New(mongo.ErrorNoUserInfo)).Times(1)
+	v.btcd.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(602288)}, nil).Times(1)
+	v.btcd.EXPECT().SearchRawTransactions(address, int64(0), int64(2000)).Return(nil, errors.New(btcd.ErrorNoDataReturned)).Times(1)
+	v.redis.EXPECT().Del(stateKey).Return(nil).Times(1)
+
+	balance, err := v.account.GetAddressBalance(context.Background(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 0 {
+		t.Errorf("Expected phantom balance rolled back, got %v", balance)
+	}
+}
+
+func TestAccountTipRace(t *testing.T) {
+	v := initVars(t)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	rawTxs := `[{"txid": "funding", "vin": [], "vout": [{"value": 1, "scriptPubKey": {"addresses": ["` + address + `"]}}], "blockhash": "block", "confirmations": 102289, "blocktime": 1540000000}]`
+	var txs []btcd.ResponseSearchRawTransactions
+	if err := json.Unmarshal([]byte(rawTxs), &txs); err != nil {
+		t.Fatal(err)
+	}
+	var stored *mongo.UserHistory
+
+	v.redis.EXPECT().Get(stateKey).Return(rs.StateNew, nil).Times(1)
+	// the best block moves while the page is fetched, so that the page is fetched again
+	gomock.InOrder(
+		v.btcd.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(602287)}, nil).Times(1),
+		v.btcd.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(602288)}, nil).Times(2),
+	)
+	v.btcd.EXPECT().SearchRawTransactions(address, int64(0), int64(2000)).Return(&txs, nil).Times(2)
+	v.mongo.EXPECT().PutUserHistory(gomock.Any()).Do(func(history *mongo.UserHistory) {
+		stored = history
+	}).Return(nil).Times(1)
+	v.redis.EXPECT().Set(utils.GenCacheKey(address, rs.CommandAll), gomock.Any(), gomock.Any()).Return(nil).Times(1)
+	v.redis.EXPECT().Del(stateKey).Return(nil).Times(1)
+
+	if _, err := v.account.GetAddressBalance(context.Background(), address); err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || len(stored.Blocks) != 1 || stored.Blocks[0].Height != 500000 {
+		t.Errorf("Expected the height derived from the tip after the page, got %+v", stored)
+	}
+}
+
+func TestAccountBackfillOnce(t *testing.T) {
+	v := initVars(t)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	cacheKey := utils.GenCacheKey(address, rs.CommandAll)
+	// rescanned already while the transaction could not be found on btcd
+	legacy := &mongo.UserHistory{
+		Address:      address,
+		Spents:       map[string]bool{"reorged+0": false},
+		UnspentAmts:  map[string]uint64{"reorged+0": 100000000},
+		Unspents:     []mongo.Unspent{{Transaction: "reorged", Amount: 100000000}},
+		Transactions: []string{"reorged"},
+		Skipped:      1,
+		Backfilled:   true,
+	}
+
+	v.redis.EXPECT().Get(stateKey).Return(rs.StateAlreadyExisting, nil).Times(1)
+	v.redis.EXPECT().Get(cacheKey).Return("", redis.Nil).Times(1)
+	v.mongo.EXPECT().GetUserHistory(address).Return(legacy, nil).Times(1)
+	v.btcd.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(602288)}, nil).AnyTimes()
+	v.btcd.EXPECT().SearchRawTransactions(address, int64(1), int64(2000)).Return(nil, errors.New(btcd.ErrorNoDataReturned)).Times(1)
+	v.redis.EXPECT().Set(cacheKey, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+	v.redis.EXPECT().Del(stateKey).Return(nil).Times(1)
+
+	_, err := v.account.GetAddressHistory(context.Background(), address, 0)
+	if _, ok := err.(account.IncompleteHistoryError); !ok {
+		t.Errorf("Expected history reported incomplete without rescanning, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package account
+
+import "strconv"
+
+// Backends
+const (
+	BackendBtcd  string = "btcd"
+	BackendMongo string = "mongo"
+	BackendRedis string = "redis"
+)
+
+// BackendError wraps error returned from one of backends that the account relies on
+type BackendError struct {
+	Backend string
+	Err     error
+}
+
+func (err BackendError) Error() string {
+	return "Failure on backend " + err.Backend + ": " + err.Err.Error()
+}
+
+// Unwrap returns the underlying error returned from the backend
+func (err BackendError) Unwrap() error {
+	return err.Err
+}
+
+// StateKeyNotFoundError indicates the state key of the address is missing on redis
+type StateKeyNotFoundError struct {
+	Key string
+}
+
+func (err StateKeyNotFoundError) Error() string {
+	return "Could not find state key existing in redis: " + err.Key
+}
+
+// CorruptedDataError indicates inconsistent data is detected such as double spent, missing unspent key...
+type CorruptedDataError struct {
+	Key    string
+	Reason string
+}
+
+func (err CorruptedDataError) Error() string {
+	return err.Reason + " at key: " + err.Key
+}
+
+// IncompleteHistoryError indicates details of the transaction or the spender of the output are missing,
+// which are stored before they are recorded and could not be backfilled from btcd
+type IncompleteHistoryError struct {
+	Key string
+}
+
+func (err IncompleteHistoryError) Error() string {
+	return "History is not recorded at key: " + err.Key
+}
+
+// TooManyPointsError indicates the balance series requested holds more points than allowed
+type TooManyPointsError struct {
+	Max int
+}
+
+func (err TooManyPointsError) Error() string {
+	return "Balance series holds more than " + strconv.Itoa(err.Max) + " points, narrow down the range or widen the interval"
+}
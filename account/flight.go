@@ -0,0 +1,111 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// flight is an in-flight manipulation of user data whose result is shared by all callers
+type flight struct {
+	done    chan struct{}
+	dups    int
+	waiters int
+	cancel  context.CancelFunc
+	data    *userData
+	err     error
+	// panicked holds the value recovered from fn, which is raised again to every caller
+	panicked interface{}
+}
+
+// flightKey identifies manipulations of user data which can be shared
+// A manipulation with the handshake of state key never serves the one without it, and vice versa,
+// as it fails without the state key set by the service, and consumes the key otherwise
+type flightKey struct {
+	addr         string
+	skipStateKey bool
+}
+
+// flightGroup coalesces concurrent manipulations of user data keyed by flightKey
+// so that concurrent callers share one computation instead of racing each other
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+// inflight is shared by all accounts living in the process
+var inflight = newFlightGroup()
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		flights: make(map[flightKey]*flight),
+	}
+}
+
+// do executes fn for key unless there is one in-flight, in which case it waits for and returns its result
+// fn runs on a context detached from any caller, which is cancelled only when all callers waiting on it are gone,
+// while every caller gives up as soon as its own ctx is done
+// The returned data is shared among callers and must be treated as read-only
+func (g *flightGroup) do(ctx context.Context, key flightKey, fn func(ctx context.Context) (*userData, error)) (*userData, bool, error) {
+	// no flight takes off for the caller which has given up already
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	g.mu.Lock()
+	f, shared := g.flights[key]
+	if shared {
+		f.dups++
+	} else {
+		var flightCtx context.Context
+		f = &flight{
+			done: make(chan struct{}),
+		}
+		flightCtx, f.cancel = context.WithCancel(context.Background())
+		g.flights[key] = f
+		go g.run(flightCtx, key, f, fn)
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if f.panicked != nil {
+			panic(f.panicked)
+		}
+		return f.data, shared, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// nobody is interested in the result any more
+			f.cancel()
+			g.forget(key, f)
+		}
+		g.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// run executes fn for the flight and releases callers waiting on it even if fn panics
+func (g *flightGroup) run(ctx context.Context, key flightKey, f *flight, fn func(ctx context.Context) (*userData, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.panicked = fmt.Sprintf("%v (in-flight manipulation of user data for %s)", r, key.addr)
+		}
+		g.mu.Lock()
+		g.forget(key, f)
+		g.mu.Unlock()
+		f.cancel()
+		close(f.done)
+	}()
+
+	f.data, f.err = fn(ctx)
+}
+
+// forget removes the flight unless it is superseded already. It must be called with mu held
+func (g *flightGroup) forget(key flightKey, f *flight) {
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
@@ -0,0 +1,184 @@
+package account
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+const flightAddress = "15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR"
+
+var testFlightKey = flightKey{addr: flightAddress}
+
+func TestFlightGroupCoalesce(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	calls := 0
+	expected := &userData{Total: 6292938}
+	fn := func(ctx context.Context) (*userData, error) {
+		calls++
+		<-release
+		return expected, nil
+	}
+
+	const callers = 3
+	var wg sync.WaitGroup
+	results := make([]*userData, callers)
+	shares := make([]bool, callers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], shares[0], _ = g.do(context.Background(), testFlightKey, fn)
+	}()
+	// waits until the first caller takes off
+	for {
+		g.mu.Lock()
+		_, ok := g.flights[testFlightKey]
+		g.mu.Unlock()
+		if ok {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	for i := 1; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], shares[i], _ = g.do(context.Background(), testFlightKey, fn)
+		}(i)
+	}
+	// waits until the others join in
+	for {
+		g.mu.Lock()
+		dups := g.flights[testFlightKey].dups
+		g.mu.Unlock()
+		if dups == callers-1 {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected one computation, got %d", calls)
+	}
+	for i := 0; i < callers; i++ {
+		if results[i] != expected {
+			t.Fail()
+		}
+		if shares[i] != (i != 0) {
+			t.Fail()
+		}
+	}
+	if _, ok := g.flights[testFlightKey]; ok {
+		t.Fail()
+	}
+}
+
+func TestFlightGroupDetached(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	aborted := make(chan struct{})
+	expected := &userData{Total: 6292938}
+	fn := func(ctx context.Context) (*userData, error) {
+		select {
+		case <-release:
+			return expected, nil
+		case <-ctx.Done():
+			close(aborted)
+			return nil, ctx.Err()
+		}
+	}
+
+	// the initiator gives up while another caller still awaits the result
+	ctx, cancel := context.WithCancel(context.Background())
+	initiated := make(chan error)
+	go func() {
+		_, _, err := g.do(ctx, testFlightKey, fn)
+		initiated <- err
+	}()
+	joined := make(chan *userData)
+	go func() {
+		data, _, _ := g.do(context.Background(), testFlightKey, fn)
+		joined <- data
+	}()
+	for {
+		g.mu.Lock()
+		f, ok := g.flights[testFlightKey]
+		waiters := 0
+		if ok {
+			waiters = f.waiters
+		}
+		g.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		runtime.Gosched()
+	}
+	cancel()
+	if err := <-initiated; err != context.Canceled {
+		t.Fatalf("expected the initiator cancelled, got %v", err)
+	}
+	close(release)
+	if data := <-joined; data != expected {
+		t.Fatalf("expected the result shared with the remaining caller, got %v", data)
+	}
+
+	// the flight is cancelled once all callers are gone
+	ctx, cancel = context.WithCancel(context.Background())
+	release = make(chan struct{})
+	go func() {
+		_, _, err := g.do(ctx, testFlightKey, fn)
+		initiated <- err
+	}()
+	for {
+		g.mu.Lock()
+		_, ok := g.flights[testFlightKey]
+		g.mu.Unlock()
+		if ok {
+			break
+		}
+		runtime.Gosched()
+	}
+	cancel()
+	<-initiated
+	<-aborted
+}
+
+func TestFlightGroupStateKey(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	handshaking := make(chan *userData)
+	go func() {
+		data, _, _ := g.do(context.Background(), testFlightKey, func(ctx context.Context) (*userData, error) {
+			<-release
+			return &userData{Total: 1}, nil
+		})
+		handshaking <- data
+	}()
+	for {
+		g.mu.Lock()
+		_, ok := g.flights[testFlightKey]
+		g.mu.Unlock()
+		if ok {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	// the caller skipping the handshake of state key never joins the one which does not
+	expected := &userData{Total: 2}
+	data, shared, err := g.do(context.Background(), flightKey{flightAddress, true}, func(ctx context.Context) (*userData, error) {
+		return expected, nil
+	})
+	if err != nil || shared || data != expected {
+		t.Fatalf("expected a separate flight, got %v %v %v", data, shared, err)
+	}
+	close(release)
+	if data := <-handshaking; data.Total != 1 {
+		t.Fatalf("unexpected result %v", data)
+	}
+}
@@ -35,6 +35,8 @@ type response struct {
 type Btcd interface {
 	SearchRawTransactions(addr string, startIdx int64, max int64) (*[]ResponseSearchRawTransactions, error)
 	GetInfo() (*map[string]interface{}, error)
+	GetBlockHash(height uint64) (string, error)
+	GetBestBlockHash() (string, error)
 }
 
 type btcd struct {
@@ -74,6 +76,9 @@ func (b btcd) GetInfo() (*map[string]interface{}, error) {
 	}
 
 	res, err := processRequest(&b, pl)
+	if err != nil {
+		return nil, err
+	}
 	if res.Error != (responseError{}) {
 		logger.LogOnError(err, "Failed to create payload")
 		return nil, JSONRPCError{Code: res.Error.Code, Message: res.Error.Message}
@@ -111,10 +116,80 @@ type ResponseSearchRawTransactions struct {
 	Txid          string `json:"txid"`
 	Vins          []vin  `json:"vin"`
 	Vouts         []vout `json:"vout"`
+	Blockhash     string `json:"blockhash"`
 	Confirmations uint64 `json:"confirmations"`
 	Blocktime     uint64 `json:"blocktime"`
 }
 
+// GetBlockHash returns the hash of the block at the height on the main chain
+// The height beyond the best block is reported as error 'ErrorBlockHeightOutOfRange'
+func (b btcd) GetBlockHash(height uint64) (string, error) {
+	// params:
+	// 1. height (numeric, required) - the height of the block on the main chain
+	payload := request{
+		JSONRPC: "1.0",
+		ID:      "0",
+		METHOD:  "getblockhash",
+		PARAMS:  []interface{}{height},
+	}
+	pl, err := json.Marshal(payload)
+	if err != nil {
+		logger.LogOnError(err, "Failed to create payload")
+		return "", err
+	}
+
+	res, err := processRequest(&b, pl)
+	if err != nil {
+		return "", err
+	}
+	if res.Error != (responseError{}) {
+		// btcd responds with -1 while bitcoind responds with -8
+		if res.Error.Code == -1 || res.Error.Code == -8 {
+			return "", errors.New(ErrorBlockHeightOutOfRange)
+		}
+		return "", JSONRPCError{Code: res.Error.Code, Message: res.Error.Message}
+	}
+
+	var result string
+	if err := json.Unmarshal([]byte(res.Result), &result); err != nil {
+		logger.LogOnError(err, "Failed to parse response - phase 1")
+		return "", err
+	}
+
+	return result, nil
+}
+
+// GetBestBlockHash returns the hash of the best block on the main chain
+func (b btcd) GetBestBlockHash() (string, error) {
+	payload := request{
+		JSONRPC: "1.0",
+		ID:      "0",
+		METHOD:  "getbestblockhash",
+		PARAMS:  []interface{}{},
+	}
+	pl, err := json.Marshal(payload)
+	if err != nil {
+		logger.LogOnError(err, "Failed to create payload")
+		return "", err
+	}
+
+	res, err := processRequest(&b, pl)
+	if err != nil {
+		return "", err
+	}
+	if res.Error != (responseError{}) {
+		return "", JSONRPCError{Code: res.Error.Code, Message: res.Error.Message}
+	}
+
+	var result string
+	if err := json.Unmarshal([]byte(res.Result), &result); err != nil {
+		logger.LogOnError(err, "Failed to parse response - phase 1")
+		return "", err
+	}
+
+	return result, nil
+}
+
 // SearchRawTransactions get relevant transactions with given bitcoin address
 func (b btcd) SearchRawTransactions(addr string, startIdx int64, max int64) (*[]ResponseSearchRawTransactions, error) {
 	// params:
@@ -137,6 +212,9 @@ func (b btcd) SearchRawTransactions(addr string, startIdx int64, max int64) (*[]
 	}
 
 	res, err := processRequest(&b, pl)
+	if err != nil {
+		return nil, err
+	}
 	if res.Error != (responseError{}) {
 		if res.Error.Code == -5 {
 			return nil, errors.New(ErrorNoDataReturned)
@@ -23,3 +23,6 @@ func (err JSONRPCError) Error() string {
 
 // ErrorNoDataReturned indicates no information returned with the given range
 const ErrorNoDataReturned string = "No information for the requested range"
+
+// ErrorBlockHeightOutOfRange indicates the main chain is shorter than the requested height
+const ErrorBlockHeightOutOfRange string = "Block height out of range"
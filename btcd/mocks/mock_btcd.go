@@ -62,3 +62,33 @@ func (mr *MockBtcdMockRecorder) GetInfo() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInfo", reflect.TypeOf((*MockBtcd)(nil).GetInfo))
 }
+
+// GetBlockHash mocks base method
+func (m *MockBtcd) GetBlockHash(height uint64) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBlockHash", height)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBlockHash indicates an expected call of GetBlockHash
+func (mr *MockBtcdMockRecorder) GetBlockHash(height interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBlockHash", reflect.TypeOf((*MockBtcd)(nil).GetBlockHash), height)
+}
+
+// GetBestBlockHash mocks base method
+func (m *MockBtcd) GetBestBlockHash() (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBestBlockHash")
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBestBlockHash indicates an expected call of GetBestBlockHash
+func (mr *MockBtcdMockRecorder) GetBestBlockHash() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBestBlockHash", reflect.TypeOf((*MockBtcd)(nil).GetBestBlockHash))
+}
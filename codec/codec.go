@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+// Content types
+const (
+	ContentTypeText    = "text/plain"
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgpack = "application/msgpack"
+	// ContentTypeMsgpackLegacy is the unregistered name still used by many clients
+	ContentTypeMsgpackLegacy = "application/x-msgpack"
+)
+
+// EncodingGzip is the only content encoding supported
+const EncodingGzip = "gzip"
+
+// Codec encodes and decodes payloads of the content type
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// ForContentType returns the codec of the content type
+// Content types unknown or absent fall back to JSON, which is labeled 'text/plain' unless asked for 'application/json'
+func ForContentType(contentType string) Codec {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch mediaType {
+	case ContentTypeMsgpack, ContentTypeMsgpackLegacy:
+		return msgpackCodec{mediaType}
+	case ContentTypeJSON:
+		return jsonCodec{ContentTypeJSON}
+	}
+	return jsonCodec{ContentTypeText}
+}
+
+type jsonCodec struct {
+	contentType string
+}
+
+func (c jsonCodec) ContentType() string {
+	return c.contentType
+}
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec names fields after json tags so that both encodings share the same schema
+type msgpackCodec struct {
+	contentType string
+}
+
+func (c msgpackCodec) ContentType() string {
+	return c.contentType
+}
+
+func (c msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf).UseJSONTag(true).UseCompactEncoding(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).Decode(v)
+}
+
+// Compress encodes the data with the content encoding. Data is left as it is without encoding
+func Compress(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, UnsupportedEncodingError{Encoding: encoding}
+}
+
+// Decompress decodes the data with the content encoding. Data is left as it is without encoding
+func Decompress(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case EncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, UnsupportedEncodingError{Encoding: encoding}
+}
@@ -0,0 +1,10 @@
+package codec
+
+// UnsupportedEncodingError indicates the content encoding is unknown
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (err UnsupportedEncodingError) Error() string {
+	return "Unsupported content encoding: " + err.Encoding
+}
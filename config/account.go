@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"strconv"
+)
+
+// Names
+const (
+	AccountRequiredConfirmations string = "ACCOUNT_REQUIRED_CONFIRMATIONS"
+	AccountMaxSeriesPoints       string = "ACCOUNT_MAX_SERIES_POINTS"
+)
+
+// Default values
+const (
+	DefaultAccountRequiredConfirmations uint64 = 6
+	DefaultAccountMaxSeriesPoints       int    = 10000
+)
+
+// AccountConfig prepared for runtime environment
+type AccountConfig struct {
+	RequiredConfirmations uint64
+	MaxSeriesPoints       int
+}
+
+// LoadAccountConfig returns AccountConfig
+func LoadAccountConfig() (*AccountConfig, error) {
+	requiredConfirmations, err := strconv.ParseUint(os.Getenv(AccountRequiredConfirmations), 10, 64)
+	if err != nil {
+		EmptyOnLoad(AccountRequiredConfirmations, true, strconv.FormatUint(DefaultAccountRequiredConfirmations, 10))
+		requiredConfirmations = DefaultAccountRequiredConfirmations
+	}
+
+	maxSeriesPoints, err := strconv.Atoi(os.Getenv(AccountMaxSeriesPoints))
+	if err != nil {
+		EmptyOnLoad(AccountMaxSeriesPoints, true, strconv.Itoa(DefaultAccountMaxSeriesPoints))
+		maxSeriesPoints = DefaultAccountMaxSeriesPoints
+	}
+
+	return &AccountConfig{
+		RequiredConfirmations: requiredConfirmations,
+		MaxSeriesPoints:       maxSeriesPoints,
+	}, nil
+}
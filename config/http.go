@@ -0,0 +1,31 @@
+package config
+
+import "os"
+
+// Names
+const (
+	HTTPListen string = "HTTP_LISTEN"
+)
+
+// Default values
+const (
+	DefaultHTTPListen string = "127.0.0.1:8080"
+)
+
+// HTTPConfig prepared for runtime environment
+type HTTPConfig struct {
+	Listen string
+}
+
+// LoadHTTPConfig returns HTTPConfig
+func LoadHTTPConfig() (*HTTPConfig, error) {
+	listen := os.Getenv(HTTPListen)
+	if listen == "" {
+		EmptyOnLoad(HTTPListen, true, DefaultHTTPListen)
+		listen = DefaultHTTPListen
+	}
+
+	return &HTTPConfig{
+		Listen: listen,
+	}, nil
+}
@@ -1,12 +1,16 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+)
 
 // Names
 const (
 	RabbitMQHost     string = "RABBITMQ_HOST"
 	RabbitMQUser     string = "RABBITMQ_USER"
 	RabbitMQPassword string = "RABBITMQ_PASSWORD"
+	RabbitMQPrefetch string = "RABBITMQ_PREFETCH"
 )
 
 // Default values
@@ -14,6 +18,7 @@ const (
 	DefaultRabbitMQHost     string = "127.0.0.1:5672"
 	DefaultRabbitMQUser     string = "guest"
 	DefaultRabbitMQPassword string = "guest"
+	DefaultRabbitMQPrefetch int    = 10
 )
 
 // RabbitMQConfig prepared for runtime environment
@@ -21,6 +26,7 @@ type RabbitMQConfig struct {
 	Host     string
 	Username string
 	Password string
+	Prefetch int
 }
 
 // GetConnectionString returns url represented as connection string
@@ -51,9 +57,16 @@ func LoadRabbitMQConfig() (*RabbitMQConfig, error) {
 		pass = DefaultRabbitMQPassword
 	}
 
+	prefetch, err := strconv.Atoi(os.Getenv(RabbitMQPrefetch))
+	if err != nil || prefetch <= 0 {
+		EmptyOnLoad(RabbitMQPrefetch, true, strconv.Itoa(DefaultRabbitMQPrefetch))
+		prefetch = DefaultRabbitMQPrefetch
+	}
+
 	return &RabbitMQConfig{
 		Host:     host,
 		Username: user,
 		Password: pass,
+		Prefetch: prefetch,
 	}, nil
 }
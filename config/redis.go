@@ -1,23 +1,35 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+)
 
 // Names
 const (
-	RedisHost     string = "REDIS_HOST"
-	RedisPassword string = "REDIS_PASSWORD"
+	RedisHost            string = "REDIS_HOST"
+	RedisPassword        string = "REDIS_PASSWORD"
+	RedisStreamGroup     string = "REDIS_STREAM_GROUP"
+	RedisStreamConsumer  string = "REDIS_STREAM_CONSUMER"
+	RedisStreamClaimIdle string = "REDIS_STREAM_CLAIM_IDLE"
 )
 
 // Default values
 const (
-	DefaultRedisHost     string = "127.0.0.1:6379"
-	DefaultRedisPassword string = ""
+	DefaultRedisHost            string = "127.0.0.1:6379"
+	DefaultRedisPassword        string = ""
+	DefaultRedisStreamGroup     string = "btcd-address-indexing-worker"
+	DefaultRedisStreamClaimIdle int64  = 300
 )
 
 // RedisConfig prepared for runtime environment
 type RedisConfig struct {
-	Host     string
-	Password string
+	Host           string
+	Password       string
+	StreamGroup    string
+	StreamConsumer string
+	// StreamClaimIdle is the time in seconds after which entries pending on other consumers are claimed
+	StreamClaimIdle int64
 }
 
 // LoadRedisConfig returns RedisConfig
@@ -34,8 +46,35 @@ func LoadRedisConfig() (*RedisConfig, error) {
 		pass = DefaultRedisPassword
 	}
 
+	group := os.Getenv(RedisStreamGroup)
+	if group == "" {
+		EmptyOnLoad(RedisStreamGroup, true, DefaultRedisStreamGroup)
+		group = DefaultRedisStreamGroup
+	}
+
+	// consumer name must be stable across restarts so that pending entries are served again
+	consumer := os.Getenv(RedisStreamConsumer)
+	if consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			FailOnLoad(err, RedisStreamConsumer)
+			return nil, err
+		}
+		EmptyOnLoad(RedisStreamConsumer, true, hostname)
+		consumer = hostname
+	}
+
+	claimIdle, err := strconv.ParseInt(os.Getenv(RedisStreamClaimIdle), 10, 64)
+	if err != nil || claimIdle <= 0 {
+		EmptyOnLoad(RedisStreamClaimIdle, true, strconv.FormatInt(DefaultRedisStreamClaimIdle, 10))
+		claimIdle = DefaultRedisStreamClaimIdle
+	}
+
 	return &RedisConfig{
-		Host:     host,
-		Password: pass,
+		Host:            host,
+		Password:        pass,
+		StreamGroup:     group,
+		StreamConsumer:  consumer,
+		StreamClaimIdle: claimIdle,
 	}, nil
 }
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+// Names
+const (
+	WorkerConcurrency      string = "WORKER_CONCURRENCY"
+	WorkerBatchConcurrency string = "WORKER_BATCH_CONCURRENCY"
+	WorkerShutdownTimeout  string = "WORKER_SHUTDOWN_TIMEOUT"
+	WorkerMode             string = "WORKER_MODE"
+	WorkerTransport        string = "WORKER_TRANSPORT"
+	WorkerMaxRetries       string = "WORKER_MAX_RETRIES"
+	WorkerChunkSize        string = "WORKER_CHUNK_SIZE"
+	WorkerMaxBatchSize     string = "WORKER_MAX_BATCH_SIZE"
+)
+
+// Worker modes
+const (
+	WorkerModeAMQP string = "amqp"
+	WorkerModeHTTP string = "http"
+	WorkerModeBoth string = "both"
+)
+
+// Worker transports
+const (
+	WorkerTransportRabbitMQ string = "rabbitmq"
+	WorkerTransportRedis    string = "redis"
+)
+
+// Default values
+const (
+	DefaultWorkerConcurrency      int    = 10
+	DefaultWorkerBatchConcurrency int    = 5
+	DefaultWorkerShutdownTimeout  int64  = 30
+	DefaultWorkerMode             string = WorkerModeAMQP
+	DefaultWorkerTransport        string = WorkerTransportRabbitMQ
+	DefaultWorkerMaxRetries       int    = 3
+	DefaultWorkerChunkSize        int    = 1000
+	DefaultWorkerMaxBatchSize     int    = 100
+)
+
+// WorkerConfig prepared for runtime environment
+type WorkerConfig struct {
+	Concurrency      int
+	BatchConcurrency int
+	ShutdownTimeout  int64
+	Mode             string
+	Transport        string
+	MaxRetries       int
+	ChunkSize        int
+	MaxBatchSize     int
+}
+
+// LoadWorkerConfig returns WorkerConfig
+func LoadWorkerConfig() (*WorkerConfig, error) {
+	concurrency, err := strconv.Atoi(os.Getenv(WorkerConcurrency))
+	if err != nil || concurrency <= 0 {
+		EmptyOnLoad(WorkerConcurrency, true, strconv.Itoa(DefaultWorkerConcurrency))
+		concurrency = DefaultWorkerConcurrency
+	}
+
+	batchConcurrency, err := strconv.Atoi(os.Getenv(WorkerBatchConcurrency))
+	if err != nil || batchConcurrency <= 0 {
+		EmptyOnLoad(WorkerBatchConcurrency, true, strconv.Itoa(DefaultWorkerBatchConcurrency))
+		batchConcurrency = DefaultWorkerBatchConcurrency
+	}
+
+	shutdownTimeout, err := strconv.ParseInt(os.Getenv(WorkerShutdownTimeout), 10, 64)
+	if err != nil || shutdownTimeout < 0 {
+		EmptyOnLoad(WorkerShutdownTimeout, true, strconv.FormatInt(DefaultWorkerShutdownTimeout, 10))
+		shutdownTimeout = DefaultWorkerShutdownTimeout
+	}
+
+	mode := os.Getenv(WorkerMode)
+	switch mode {
+	case "":
+		EmptyOnLoad(WorkerMode, true, DefaultWorkerMode)
+		mode = DefaultWorkerMode
+	case WorkerModeAMQP, WorkerModeHTTP, WorkerModeBoth:
+	default:
+		err := errors.New("Unsupported worker mode " + mode)
+		FailOnLoad(err, WorkerMode)
+		return nil, err
+	}
+
+	transport := os.Getenv(WorkerTransport)
+	switch transport {
+	case "":
+		EmptyOnLoad(WorkerTransport, true, DefaultWorkerTransport)
+		transport = DefaultWorkerTransport
+	case WorkerTransportRabbitMQ, WorkerTransportRedis:
+	default:
+		err := errors.New("Unsupported worker transport " + transport)
+		FailOnLoad(err, WorkerTransport)
+		return nil, err
+	}
+
+	maxRetries, err := strconv.Atoi(os.Getenv(WorkerMaxRetries))
+	if err != nil || maxRetries < 0 {
+		EmptyOnLoad(WorkerMaxRetries, true, strconv.Itoa(DefaultWorkerMaxRetries))
+		maxRetries = DefaultWorkerMaxRetries
+	}
+
+	chunkSize, err := strconv.Atoi(os.Getenv(WorkerChunkSize))
+	if err != nil || chunkSize <= 0 {
+		EmptyOnLoad(WorkerChunkSize, true, strconv.Itoa(DefaultWorkerChunkSize))
+		chunkSize = DefaultWorkerChunkSize
+	}
+
+	maxBatchSize, err := strconv.Atoi(os.Getenv(WorkerMaxBatchSize))
+	if err != nil || maxBatchSize <= 0 {
+		EmptyOnLoad(WorkerMaxBatchSize, true, strconv.Itoa(DefaultWorkerMaxBatchSize))
+		maxBatchSize = DefaultWorkerMaxBatchSize
+	}
+
+	return &WorkerConfig{
+		Concurrency:      concurrency,
+		BatchConcurrency: batchConcurrency,
+		ShutdownTimeout:  shutdownTimeout,
+		Mode:             mode,
+		Transport:        transport,
+		MaxRetries:       maxRetries,
+		ChunkSize:        chunkSize,
+		MaxBatchSize:     maxBatchSize,
+	}, nil
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -17,160 +17,200 @@ import (
 	"github.com/junzhli/btcd-address-indexing-worker/logger"
 	"github.com/junzhli/btcd-address-indexing-worker/mongo"
 	rs "github.com/junzhli/btcd-address-indexing-worker/redis"
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+	"github.com/junzhli/btcd-address-indexing-worker/transport/rabbitmq"
+	"github.com/junzhli/btcd-address-indexing-worker/transport/redisstream"
+	"github.com/junzhli/btcd-address-indexing-worker/worker"
 
 	"github.com/go-bongo/bongo"
 	"github.com/go-redis/redis"
-	"github.com/streadway/amqp"
 )
 
-type request struct {
-	Account string `json:"account"`
-	Task    string `json:"task"`
-}
-
-type responseBase struct {
-	Command string `json:"command"`
-	Account string `json:"account"`
-}
+// shutdownGracePeriod is the time awaiting tasks to abort after they are cancelled on shutdown timeout
+const shutdownGracePeriod = 5 * time.Second
 
-type responseBalance struct {
-	responseBase
-	DataBalance float64 `json:"data"`
-}
-
-type responseTransactions struct {
-	responseBase
-	DataTx []string `json:"data"`
-}
+func main() {
+	err := godotenv.Load()
+	if err != nil {
+		logger.LogOnError(err, "Warning: unable to load .env file")
+	}
+	if len(os.Args) > 1 && os.Args[1] == commandQuery {
+		os.Exit(runQuery(os.Args[2:]))
+	}
 
-type responseUnspents struct {
-	responseBase
-	DataUspt []mongo.Unspent `json:"data"`
-}
+	accountConf, rsConf, closeAccount := initAccount()
+	defer closeAccount()
+	rabbitMqConf, err := config.LoadRabbitMQConfig()
+	if err != nil {
+		logger.FailOnError(err, "Failed to load env for RabbitMQ")
+	}
+	workerConf, err := config.LoadWorkerConfig()
+	if err != nil {
+		logger.FailOnError(err, "Failed to load env for worker")
+	}
 
-type responseAll struct {
-	responseBase
-	DataAll account.UserData `json:"data"`
-}
+	stopping := make(chan bool)
+	// tasks in flight are cancelled once the shutdown timeout is exceeded
+	tasksCtx, cancelTasks := context.WithCancel(context.Background())
+	defer cancelTasks()
+	var workers sync.WaitGroup
+	var tr transport.Transport
+	if workerConf.Mode != config.WorkerModeHTTP {
+		tr = initTransport(workerConf, rabbitMqConf, rsConf)
+		defer tr.Close()
+		startConsumers(tasksCtx, tr, &worker.Config{
+			Account:          accountConf,
+			MaxRetries:       workerConf.MaxRetries,
+			BatchConcurrency: workerConf.BatchConcurrency,
+			ChunkSize:        workerConf.ChunkSize,
+			MaxBatchSize:     workerConf.MaxBatchSize,
+		}, workerConf.Concurrency, stopping, &workers)
+	}
 
-// commands
-const (
-	CommandBalance      = "balance"
-	CommandTransactions = "transactions"
-	CommandUnspents     = "unspents"
-	CommandAll          = "all"
-)
+	var server *http.Server
+	if workerConf.Mode != config.WorkerModeAMQP {
+		httpConf, err := config.LoadHTTPConfig()
+		if err != nil {
+			logger.FailOnError(err, "Failed to load env for HTTP")
+		}
+		// queries over HTTP don't come along with state key set by the service
+		httpAccountConf := *accountConf
+		httpAccountConf.SkipStateKey = true
+		server = &http.Server{
+			Addr:    httpConf.Listen,
+			Handler: worker.NewHTTPHandler(&httpAccountConf),
+		}
+		go func() {
+			log.Printf("HTTP server listening on %s", httpConf.Listen)
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				logger.FailOnError(err, "HTTP server stopped unexpectedly")
+			}
+		}()
+	}
 
-const exAccountReq = "account_req"
-const exAccountRet = "account_ret"
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf(" [*] Waiting for requests. To exit press CTRL+C")
+	<-sig
+
+	log.Println("Stopping consumption and awaiting in-flight tasks to gracefully shutdown...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(workerConf.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if tr != nil {
+		err = tr.StopConsuming()
+		logger.LogOnError(err, "Failed to cancel the consumer")
+	}
+	close(stopping)
 
-func doTask(wg *sync.WaitGroup, id int, c chan bool, d amqp.Delivery, config *account.Config, messageChannel *amqp.Channel) {
-	defer wg.Done()
-	c <- true
-	lg := log.New(os.Stdout, "[Task "+strconv.Itoa(id)+"] ", log.LstdFlags)
-	lg2 := logger.New(lg)
-	acout := account.New(lg, lg2, config)
-	lg.Printf("Received a message: %s", d.Body)
+	if server != nil {
+		err = server.Shutdown(shutdownCtx)
+		logger.LogOnError(err, "Failed to shutdown HTTP server gracefully")
+	}
 
-	var req request
-	err := json.Unmarshal(d.Body, &req)
-	if err != nil {
-		lg2.LogOnError(err, "Failed to parse request message from receiverChannel")
+	finished := make(chan bool)
+	go func() {
+		workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		log.Println("All in-flight tasks are finished")
+	case <-shutdownCtx.Done():
+		log.Println("Shutdown timeout exceeded... cancelling in-flight tasks and requeueing their messages")
+		cancelTasks()
+		select {
+		case <-finished:
+		case <-time.After(shutdownGracePeriod):
+			log.Println("In-flight tasks are not yet aborted... unsettled messages are left to the broker for redelivery")
+		}
 	}
 
-	if err == nil {
-		lg.Printf("Task is requested with parameters: addr => " + req.Account + " task => " + req.Task)
-		startTime := time.Now()
-		var res []byte
-		switch req.Task {
-		case CommandBalance:
-			balance, err := acout.GetAddressBalance(req.Account)
-			if err != nil {
-				lg2.LogOnError(err, "Fails on the task")
-				break
-			}
-			res, err = json.Marshal(responseBalance{
-				responseBase{
-					CommandBalance,
-					req.Account,
-				},
-				balance,
-			})
-		case CommandTransactions:
-			transactions, err := acout.GetAddressTransactions(req.Account)
-			if err != nil {
-				lg2.LogOnError(err, "Fails on the task")
-				break
-			}
-			res, err = json.Marshal(responseTransactions{
-				responseBase{
-					CommandTransactions,
-					req.Account,
-				},
-				transactions,
-			})
-		case CommandUnspents:
-			unspents, err := acout.GetAddressUnspentOutputs(req.Account)
-			if err != nil {
-				lg2.LogOnError(err, "Fails on the task")
-				break
+	if tr != nil {
+		// deliveries prefetched but not yet picked up by workers go back to the queue
+		for {
+			select {
+			case d, ok := <-tr.Deliveries():
+				if ok {
+					requeueOnShutdown(tr, d)
+					continue
+				}
+			case <-time.After(time.Second):
 			}
+			break
+		}
+	}
+	log.Println("Shutdown gracefully")
+}
 
-			_unspents := make([]mongo.Unspent, 0)
-			for _, val := range unspents {
-				_unspents = append(_unspents, *val)
+// startConsumers starts a fixed number of workers pulling deliveries, whose backlog is bounded by the transport
+// Workers stop picking up deliveries once stopping is closed, and tasks in flight are aborted once ctx is cancelled
+func startConsumers(ctx context.Context, tr transport.Transport, workerConf *worker.Config, concurrency int, stopping chan bool, workers *sync.WaitGroup) {
+	for i := 1; i <= concurrency; i++ {
+		workers.Add(1)
+		go func(id int) {
+			defer workers.Done()
+			for {
+				select {
+				case <-stopping:
+					return
+				case d, ok := <-tr.Deliveries():
+					if !ok {
+						return
+					}
+					select {
+					case <-stopping:
+						requeueOnShutdown(tr, d)
+						return
+					default:
+					}
+
+					log.Printf("Task received by worker %d", id)
+					worker.DoTaskContext(ctx, id, d, workerConf, tr)
+				}
 			}
+		}(i)
+	}
+	log.Printf("Consumer ready with %d workers, PID: %d", concurrency, os.Getpid())
+}
 
-			res, err = json.Marshal(responseUnspents{
-				responseBase{
-					CommandUnspents,
-					req.Account,
-				},
-				_unspents,
-			})
-		case CommandAll:
-			result, err := acout.GetAddressResult(req.Account)
-			if err != nil {
-				lg2.LogOnError(err, "Fails on the task")
-				break
-			}
+// requeueOnShutdown hands the delivery back to the queue untouched
+func requeueOnShutdown(tr transport.Transport, d transport.Delivery) {
+	err := tr.Nack(d, true)
+	logger.LogOnError(err, "Failed to requeue the delivery on shutdown")
+}
 
-			res, err = json.Marshal(responseAll{
-				responseBase{
-					CommandAll,
-					req.Account,
-				},
-				*result,
-			})
-		default:
-			panic("Unsupported task")
+// initTransport connects to the transport chosen by config
+func initTransport(workerConf *config.WorkerConfig, rabbitMqConf *config.RabbitMQConfig, rsConf *config.RedisConfig) transport.Transport {
+	var tr transport.Transport
+	var err error
+	switch workerConf.Transport {
+	case config.WorkerTransportRedis:
+		tr, err = redisstream.New(
+			&redis.Options{
+				Addr:     rsConf.Host,
+				Password: rsConf.Password,
+				DB:       0,
+			},
+			rsConf.StreamGroup,
+			rsConf.StreamConsumer,
+			int64(workerConf.Concurrency),
+			time.Duration(rsConf.StreamClaimIdle)*time.Second,
+		)
+		if err != nil {
+			logger.FailOnError(err, "An error has occurred when Redis stream gets consumed")
 		}
-
+	default:
+		tr, err = rabbitmq.New(rabbitMqConf)
 		if err != nil {
-			lg2.LogOnError(err, "Failed to output the result for the task")
-		} else {
-			messageChannel.Publish(
-				exAccountRet,
-				"",
-				false,
-				false,
-				amqp.Publishing{
-					ContentType: "text/plain",
-					Body:        res,
-				},
-			)
+			logger.FailOnError(err, "An error has occurred when RabbitMQ gets connected")
 		}
-		elapsedTime := time.Since(startTime)
-		lg.Println("The requested task takes " + elapsedTime.String())
 	}
-	<-c
+	return tr
 }
 
-func main() {
-	err := godotenv.Load()
-	if err != nil {
-		logger.LogOnError(err, "Warning: unable to load .env file")
-	}
+// initAccount loads env for backends of the account pipeline and connects to them
+// The returned function closes the connections
+func initAccount() (*account.Config, *config.RedisConfig, func()) {
 	rsConf, err := config.LoadRedisConfig()
 	if err != nil {
 		logger.FailOnError(err, "Failed to load env for Redis")
@@ -183,72 +223,25 @@ func main() {
 	if err != nil {
 		logger.FailOnError(err, "Failed to load env for Btcd")
 	}
-	rabbitMqConf, err := config.LoadRabbitMQConfig()
+	accConf, err := config.LoadAccountConfig()
 	if err != nil {
-		logger.FailOnError(err, "Failed to load env for RabbitMQ")
+		logger.FailOnError(err, "Failed to load env for Account")
 	}
 
 	rs := initRedis(rsConf)
-	defer rs.Close()
 	db := initMongoDb(dbConf)
-	defer db.Session.Close()
-	receiver, messageChannel, rabbitMqConn := initRabbitMq(rabbitMqConf)
-	defer messageChannel.Close()
-	defer rabbitMqConn.Close()
 	node := btcd.New("https://"+btcdConf.Host, btcdConf.Username, btcdConf.Password, time.Duration(btcdConf.Timeout))
-	mongo := mongo.New(db)
-
-	running := true
-	var wg sync.WaitGroup
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sig
-		running = false
-		log.Println("Awaiting goroutines to gracefully shutdown...")
-		wg.Wait()
-		db.Session.Close()
-		messageChannel.Close()
-		rabbitMqConn.Close()
+	accountConf := &account.Config{
+		Btcd:                  node,
+		Mongo:                 mongo.New(db),
+		Redis:                 rs,
+		RequiredConfirmations: accConf.RequiredConfirmations,
+		MaxSeriesPoints:       accConf.MaxSeriesPoints,
+	}
+	return accountConf, rsConf, func() {
 		rs.Close()
-		os.Exit(1)
-	}()
-
-	maxTasks := 10000
-	forever := make(chan bool)
-	taskPool := make(chan bool, maxTasks)
-	tasks := 0
-	go func() {
-		config := &account.Config{
-			Btcd:  node,
-			Mongo: mongo,
-			Redis: rs,
-		}
-
-		log.Printf("Consumer ready, PID: %d", os.Getpid())
-		for d := range receiver {
-			if !running {
-				continue
-			}
-
-			log.Printf("Task received")
-			if tasks >= maxTasks {
-				tasks = 1
-			} else {
-				tasks++
-			}
-			wg.Add(1)
-			go doTask(&wg, tasks, taskPool, d, config, messageChannel)
-			if err := d.Ack(false); err != nil {
-				log.Printf("Ack error occurred : %s", err)
-			} else {
-				log.Printf("Ack successfully")
-			}
-		}
-	}()
-
-	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+		db.Session.Close()
+	}
 }
 
 func initRedis(config *config.RedisConfig) rs.Redis {
@@ -273,60 +266,3 @@ func initMongoDb(config *config.MongoConfig) *bongo.Connection {
 	}
 	return conn
 }
-
-func initRabbitMq(config *config.RabbitMQConfig) (<-chan amqp.Delivery, *amqp.Channel, *amqp.Connection) {
-	connection, err := amqp.Dial("amqp://" + config.GetConnectionString())
-	if err != nil {
-		logger.FailOnError(err, "An error has occurred when RabbitMQ gets connected")
-		panic(err)
-	}
-
-	channel, err := connection.Channel()
-	if err != nil {
-		logger.FailOnError(err, "Failed to create a channel over RabbitMQ")
-		panic(err)
-	}
-
-	queue, err := channel.QueueDeclare(
-		exAccountReq,
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		logger.FailOnError(err, "Failed to declare a queue with name 'account_req'")
-		panic(err)
-	}
-
-	receiverQueue, err := channel.Consume(
-		queue.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		logger.FailOnError(err, "Failed to register a consumer serving queue 'account_req'")
-		panic(err)
-	}
-
-	err = channel.ExchangeDeclare(
-		exAccountRet,
-		amqp.ExchangeFanout,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		logger.FailOnError(err, "Failed to register a responder channel for 'account_ret'")
-		panic(err)
-	}
-
-	return receiverQueue, channel, connection
-}
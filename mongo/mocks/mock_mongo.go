@@ -61,3 +61,33 @@ func (mr *MockMongoMockRecorder) GetUserHistory(addr interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserHistory", reflect.TypeOf((*MockMongo)(nil).GetUserHistory), addr)
 }
+
+// RollbackUserHistory mocks base method
+func (m *MockMongo) RollbackUserHistory(addr string, height uint64) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RollbackUserHistory", addr, height)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RollbackUserHistory indicates an expected call of RollbackUserHistory
+func (mr *MockMongoMockRecorder) RollbackUserHistory(addr, height interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RollbackUserHistory", reflect.TypeOf((*MockMongo)(nil).RollbackUserHistory), addr, height)
+}
+
+// BackfillUserHistory mocks base method
+func (m *MockMongo) BackfillUserHistory(addr string, blocks []mongo.Block, details []mongo.TxDetail, spenders map[string]string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BackfillUserHistory", addr, blocks, details, spenders)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BackfillUserHistory indicates an expected call of BackfillUserHistory
+func (mr *MockMongoMockRecorder) BackfillUserHistory(addr, blocks, details, spenders interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BackfillUserHistory", reflect.TypeOf((*MockMongo)(nil).BackfillUserHistory), addr, blocks, details, spenders)
+}
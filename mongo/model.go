@@ -15,6 +15,22 @@ type Unspent struct {
 	BlockTime    uint64
 }
 
+// Block records the block of the transaction kept in UserHistory, checked against the main chain later
+type Block struct {
+	Transaction string
+	Hash        string
+	Height      uint64
+}
+
+// TxDetail summarizes amounts of the transaction received and spent by the address, kept in UserHistory
+type TxDetail struct {
+	Transaction string
+	BlockTime   uint64
+	Height      uint64
+	Received    uint64
+	Sent        uint64
+}
+
 // UserHistory keeps all revelant information about balance, transaction history, unspent...
 // Note that it can also be used for the struct of user data in redis, well implemented in json representation as bytes array
 type UserHistory struct {
@@ -27,6 +43,12 @@ type UserHistory struct {
 	Shadowspents []string          `json:"sdspts"`
 	Transactions []string          `json:"txs"`
 	Skipped      uint64            `json:"skd"`
+	Blocks       []Block           `json:"blks"`
+	Details      []TxDetail        `json:"dtls"`
+	// Spenders maps keys of outputs to transactions spending them
+	Spenders map[string]string `json:"sptbs"`
+	// Backfilled tells legacy segments stored before details are recorded have been rescanned already
+	Backfilled bool `json:"bkfd"`
 }
 
 // userHistoryModel offers UserHistory with additional implementation in compliance with mongo model spec
@@ -41,6 +63,10 @@ type userHistoryModel struct {
 	Shadowspents       []string
 	Transactions       []string
 	Skipped            uint64
+	Blocks             []Block
+	Details            []TxDetail
+	Spenders           map[string]string
+	Backfilled         bool
 }
 
 func newUserHistoryModel(d *UserHistory) userHistoryModel {
@@ -54,5 +80,9 @@ func newUserHistoryModel(d *UserHistory) userHistoryModel {
 		Shadowspents: d.Shadowspents,
 		Transactions: d.Transactions,
 		Skipped:      d.Skipped,
+		Blocks:       d.Blocks,
+		Details:      d.Details,
+		Spenders:     d.Spenders,
+		Backfilled:   d.Backfilled,
 	}
 }
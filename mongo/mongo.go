@@ -15,6 +15,8 @@ const dbUser string = "users"
 type Mongo interface {
 	PutUserHistory(doc *UserHistory) error
 	GetUserHistory(addr string) (*UserHistory, error)
+	RollbackUserHistory(addr string, height uint64) (int, error)
+	BackfillUserHistory(addr string, blocks []Block, details []TxDetail, spenders map[string]string) (int, error)
 }
 
 type mongo struct {
@@ -49,7 +51,11 @@ func (m *mongo) GetUserHistory(addr string) (*UserHistory, error) {
 	unspts := make([]Unspent, 0)
 	shadowspts := make([]string, 0)
 	txs := make([]string, 0)
+	blks := make([]Block, 0)
+	dtls := make([]TxDetail, 0)
+	sptbs := make(map[string]string, 0)
 	skipped := histories[lastIdx].Skipped
+	backfilled := true
 
 	for _, history := range histories {
 		subtotl += history.Subtotal
@@ -58,6 +64,12 @@ func (m *mongo) GetUserHistory(addr string) (*UserHistory, error) {
 		unspts = append(unspts, history.Unspents...)
 		shadowspts = append(shadowspts, history.Shadowspents...)
 		txs = append(txs, history.Transactions...)
+		blks = append(blks, history.Blocks...)
+		dtls = append(dtls, history.Details...)
+		mergeSpenders(sptbs, history.Spenders)
+		if !history.Backfilled && len(history.Details) < len(history.Transactions) {
+			backfilled = false
+		}
 	}
 
 	return &UserHistory{
@@ -70,9 +82,114 @@ func (m *mongo) GetUserHistory(addr string) (*UserHistory, error) {
 		Shadowspents: shadowspts,
 		Transactions: txs,
 		Skipped:      skipped,
+		Blocks:       blks,
+		Details:      dtls,
+		Spenders:     sptbs,
+		Backfilled:   backfilled,
 	}, nil
 }
 
+// RollbackUserHistory removes documents of the address from the first one holding a block at given height or above
+// Later documents depend on earlier ones so that they are removed together. It returns the number of documents removed
+func (m *mongo) RollbackUserHistory(addr string, height uint64) (int, error) {
+	var histories []userHistoryModel
+	err := m.conn.Collection(dbUser).Find(bson.M{"address": addr}).Query.Sort("timestamp").All(&histories)
+	if err != nil {
+		logger.LogOnError(err, "Failed to fetch user history from database")
+		return 0, err
+	}
+
+	from := len(histories)
+	for idx, history := range histories {
+		if holdsBlockFrom(history.Blocks, height) {
+			from = idx
+			break
+		}
+	}
+
+	removed := 0
+	for idx := len(histories) - 1; idx >= from; idx-- {
+		if err := m.conn.Collection(dbUser).DeleteDocument(&histories[idx]); err != nil {
+			logger.LogOnError(err, "Failed to remove user history from database")
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// BackfillUserHistory records blocks, details and spenders of transactions stored before they are recorded
+// Every document takes those of its own transactions missing only and keeps details in the order of transactions
+// Documents missing details are marked as backfilled even if none is given, so that they are never rescanned again
+// It returns the number of documents rewritten
+func (m *mongo) BackfillUserHistory(addr string, blocks []Block, details []TxDetail, spenders map[string]string) (int, error) {
+	var histories []userHistoryModel
+	err := m.conn.Collection(dbUser).Find(bson.M{"address": addr}).Query.Sort("timestamp").All(&histories)
+	if err != nil {
+		logger.LogOnError(err, "Failed to fetch user history from database")
+		return 0, err
+	}
+
+	blks := make(map[string]Block, 0)
+	for _, blk := range blocks {
+		blks[blk.Transaction] = blk
+	}
+	dtls := make(map[string]TxDetail, 0)
+	for _, dtl := range details {
+		dtls[dtl.Transaction] = dtl
+	}
+
+	rewritten := 0
+	for idx := range histories {
+		history := &histories[idx]
+		recorded := make(map[string]TxDetail, 0)
+		for _, dtl := range history.Details {
+			recorded[dtl.Transaction] = dtl
+		}
+		owned := make(map[string]bool, 0)
+		changed := !history.Backfilled && len(history.Details) < len(history.Transactions)
+		backfilled := make([]TxDetail, 0, len(history.Transactions))
+		for _, txid := range history.Transactions {
+			owned[txid] = true
+			if dtl, ok := recorded[txid]; ok {
+				backfilled = append(backfilled, dtl)
+				continue
+			}
+			dtl, ok := dtls[txid]
+			if !ok {
+				continue
+			}
+			backfilled = append(backfilled, dtl)
+			if blk, ok := blks[txid]; ok {
+				history.Blocks = append(history.Blocks, blk)
+			}
+			changed = true
+		}
+		for key, spender := range spenders {
+			if _, ok := history.Spenders[key]; ok || !owned[spender] {
+				continue
+			}
+			if history.Spenders == nil {
+				history.Spenders = make(map[string]string, 0)
+			}
+			history.Spenders[key] = spender
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+
+		history.Details = backfilled
+		history.Backfilled = true
+		if err := m.conn.Collection(dbUser).Save(history); err != nil {
+			logger.LogOnError(err, "Failed to rewrite user history in database")
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
 // New creates an instance of Mongo
 func New(conn *bongo.Connection) Mongo {
 	return &mongo{
@@ -80,6 +197,27 @@ func New(conn *bongo.Connection) Mongo {
 	}
 }
 
+func mergeSpenders(a map[string]string, b map[string]string) error {
+	for key, val := range b {
+		if _, ok := a[key]; ok {
+			err := errors.New("Conflict occurred during the merge op from b into a: " + key)
+			return err
+		}
+
+		a[key] = val
+	}
+	return nil
+}
+
+func holdsBlockFrom(blocks []Block, height uint64) bool {
+	for _, blk := range blocks {
+		if blk.Height >= height {
+			return true
+		}
+	}
+	return false
+}
+
 func mergeSpents(a map[string]bool, b map[string]bool) error {
 	for key, val := range b {
 		if _, ok := a[key]; ok {
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/junzhli/btcd-address-indexing-worker/worker"
+)
+
+const commandQuery = "query"
+
+// queryArgs holds arguments of subcommand query parsed from command line
+type queryArgs struct {
+	task         string
+	addr         string
+	skipStateKey bool
+	timeout      time.Duration
+	opts         worker.QueryOptions
+}
+
+// runQuery serves one task for the address given on command line and prints the response to stdout
+// It returns the exit code, which is non-zero if the task fails
+//
+// Usage: btcd-address-indexing-worker query [--task all] [--units btc] [--min-confirmations 1] [--height h | --timestamp t] [--interval tx] [--from t] [--to t] [--skip-state-key] [--timeout 0] <addr>
+func runQuery(args []string) int {
+	qArgs, err := parseQueryArgs(args, os.Stderr)
+	if err != nil {
+		return 2
+	}
+
+	accountConf, _, closeAccount := initAccount()
+	defer closeAccount()
+	accountConf.SkipStateKey = qArgs.skipStateKey
+
+	ctx := context.Background()
+	if qArgs.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, qArgs.timeout)
+		defer cancel()
+	}
+
+	// logs go to stderr so that stdout holds the response only
+	lg := log.New(os.Stderr, "[Query] ", log.LstdFlags)
+	startTime := time.Now()
+	result, taskErr := worker.Query(ctx, lg, accountConf, qArgs.task, qArgs.addr, qArgs.opts)
+	lg.Println("The requested task takes " + time.Since(startTime).String())
+
+	if err := printQueryResult(os.Stdout, result); err != nil {
+		lg.Printf("Failed to output the result for the task: %s", err)
+		return 1
+	}
+	if taskErr != nil {
+		return 1
+	}
+	return 0
+}
+
+// parseQueryArgs parses flags and the address of subcommand query, reporting what goes wrong to output
+func parseQueryArgs(args []string, output io.Writer) (*queryArgs, error) {
+	flags := flag.NewFlagSet(commandQuery, flag.ContinueOnError)
+	flags.SetOutput(output)
+	task := flags.String("task", worker.CommandAll, "task to serve: balance, transactions, unspents, all, history, balanceAt or balanceSeries")
+	skipStateKey := flags.Bool("skip-state-key", false, "skip the handshake of state key on Redis, which is set by the service otherwise")
+	units := flags.String("units", worker.UnitsBTC, "units of balances: btc or satoshi")
+	minConfirmations := flags.Int("min-confirmations", 1, "count only transactions confirmed at least the times")
+	height := flags.Int("height", -1, "block height of task balanceAt")
+	timestamp := flags.String("timestamp", "", "time of task balanceAt in RFC 3339, such as 2025-12-31T23:59:59Z")
+	interval := flags.String("interval", "", "interval of task balanceSeries: tx, day or month")
+	from := flags.String("from", "", "start of task balanceSeries in RFC 3339")
+	to := flags.String("to", "", "end of task balanceSeries in RFC 3339")
+	timeout := flags.Duration("timeout", 0, "give up the task after the duration, no limit by default")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <addr>\n", os.Args[0], commandQuery)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return nil, errors.New("Exactly one address is required")
+	}
+
+	qArgs := queryArgs{
+		task:         *task,
+		addr:         flags.Arg(0),
+		skipStateKey: *skipStateKey,
+		timeout:      *timeout,
+		opts: worker.QueryOptions{
+			Units:            *units,
+			MinConfirmations: *minConfirmations,
+			Interval:         *interval,
+		},
+	}
+	if *height >= 0 {
+		qArgs.opts.Height = height
+	}
+	for _, opt := range []struct {
+		name  string
+		value string
+		dst   **time.Time
+	}{
+		{"timestamp", *timestamp, &qArgs.opts.Timestamp},
+		{"from", *from, &qArgs.opts.From},
+		{"to", *to, &qArgs.opts.To},
+	} {
+		if opt.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, opt.value)
+		if err != nil {
+			fmt.Fprintf(flags.Output(), "Invalid %s %s: %s\n", opt.name, opt.value, err)
+			return nil, err
+		}
+		*opt.dst = &t
+	}
+	return &qArgs, nil
+}
+
+// printQueryResult prints the response as indented JSON
+func printQueryResult(w io.Writer, result interface{}) error {
+	res, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(res))
+	return err
+}
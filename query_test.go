@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/junzhli/btcd-address-indexing-worker/worker"
+)
+
+const queryAddress = "15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR"
+
+func TestParseQueryArgs(t *testing.T) {
+	timestamp := time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC)
+	cases := []struct {
+		name  string
+		args  []string
+		check func(q *queryArgs) bool
+		fails bool
+	}{
+		{
+			name: "defaults",
+			args: []string{queryAddress},
+			check: func(q *queryArgs) bool {
+				return q.task == worker.CommandAll && q.addr == queryAddress && !q.skipStateKey && q.timeout == 0 &&
+					q.opts.Units == worker.UnitsBTC && q.opts.MinConfirmations == 1 && q.opts.Height == nil && q.opts.Timestamp == nil
+			},
+		},
+		{
+			name: "balanceAt by height",
+			args: []string{"--task", worker.CommandBalanceAt, "--height", "0", "--units", worker.UnitsSatoshi, "--skip-state-key", queryAddress},
+			check: func(q *queryArgs) bool {
+				return q.task == worker.CommandBalanceAt && q.opts.Height != nil && *q.opts.Height == 0 &&
+					q.opts.Units == worker.UnitsSatoshi && q.skipStateKey
+			},
+		},
+		{
+			name: "balanceAt by timestamp",
+			args: []string{"--task", worker.CommandBalanceAt, "--timestamp", "2025-12-31T23:59:59Z", "--timeout", "30s", queryAddress},
+			check: func(q *queryArgs) bool {
+				return q.opts.Timestamp != nil && q.opts.Timestamp.Equal(timestamp) && q.opts.Height == nil && q.timeout == 30*time.Second
+			},
+		},
+		{
+			name: "balanceSeries",
+			args: []string{"--task", worker.CommandBalanceSeries, "--interval", "day", "--from", "2025-01-01T00:00:00Z", "--to", "2025-12-31T23:59:59Z", queryAddress},
+			check: func(q *queryArgs) bool {
+				return q.opts.Interval == "day" && q.opts.From != nil && q.opts.To != nil && q.opts.To.Equal(timestamp)
+			},
+		},
+		{name: "missing address", args: []string{"--task", worker.CommandBalance}, fails: true},
+		{name: "extra argument", args: []string{queryAddress, queryAddress}, fails: true},
+		{name: "unknown flag", args: []string{"--account", queryAddress}, fails: true},
+		{name: "malformed flag", args: []string{"--min-confirmations", "many", queryAddress}, fails: true},
+		{name: "malformed time", args: []string{"--from", "yesterday", queryAddress}, fails: true},
+	}
+
+	for _, c := range cases {
+		q, err := parseQueryArgs(c.args, ioutil.Discard)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%s: expected failure, got %+v", c.name, q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if !c.check(q) {
+			t.Errorf("%s: unexpected arguments %+v", c.name, q)
+		}
+	}
+}
+
+func TestPrintQueryResult(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printQueryResult(&buf, map[string]interface{}{"status": "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "{\n  \"status\": \"ok\"\n}\n" {
+		t.Errorf("Unexpected output %q", buf.String())
+	}
+}
@@ -0,0 +1,156 @@
+package memory
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+)
+
+// Outcomes of settled deliveries
+const (
+	OutcomeAck        = "ack"
+	OutcomeRetry      = "retry"
+	OutcomeRequeue    = "requeue"
+	OutcomeQuarantine = "quarantine"
+)
+
+// ErrStopped indicates the transport no longer accepts deliveries
+var ErrStopped = errors.New("Transport has stopped consuming")
+
+// ErrFull indicates the backlog of the transport is full
+var ErrFull = errors.New("Transport backlog is full")
+
+// Settlement records how a delivery is settled
+type Settlement struct {
+	Delivery transport.Delivery
+	Outcome  string
+}
+
+// Message records a reply routed to the queue
+type Message struct {
+	Queue string
+	Reply transport.Reply
+}
+
+// Memory is a transport living in process memory, which is meant for tests and embedding
+// Deliveries retried or requeued are pushed back to its backlog while it is still consuming
+type Memory struct {
+	deliveries chan transport.Delivery
+
+	mu          sync.Mutex
+	stopping    bool
+	seq         int
+	settlements []Settlement
+	messages    []Message
+}
+
+// New creates an in-memory transport with the backlog of the capacity
+func New(capacity int) *Memory {
+	return &Memory{
+		deliveries: make(chan transport.Delivery, capacity),
+	}
+}
+
+// Push enqueues the delivery as if it were published to queue 'account_req'
+func (m *Memory) Push(d transport.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	d.Tag = m.seq
+	return m.enqueue(d)
+}
+
+// enqueue must be called with mu held
+func (m *Memory) enqueue(d transport.Delivery) error {
+	if m.stopping {
+		return ErrStopped
+	}
+	select {
+	case m.deliveries <- d:
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+// Settlements returns deliveries settled so far in order
+func (m *Memory) Settlements() []Settlement {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Settlement(nil), m.settlements...)
+}
+
+// Messages returns replies routed so far in order
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+func (m *Memory) settle(d transport.Delivery, outcome string) {
+	m.settlements = append(m.settlements, Settlement{d, outcome})
+}
+
+// Deliveries returns the channel of deliveries, which is closed once consumption stops
+func (m *Memory) Deliveries() <-chan transport.Delivery {
+	return m.deliveries
+}
+
+// Ack settles the delivery as done
+func (m *Memory) Ack(d transport.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settle(d, OutcomeAck)
+	return nil
+}
+
+// Retry settles the delivery and pushes it back with retry count increased
+func (m *Memory) Retry(d transport.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settle(d, OutcomeRetry)
+	d.RetryCount++
+	return m.enqueue(d)
+}
+
+// Nack pushes the delivery back with requeue, otherwise it is only recorded as quarantined
+func (m *Memory) Nack(d transport.Delivery, requeue bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !requeue {
+		m.settle(d, OutcomeQuarantine)
+		return nil
+	}
+	m.settle(d, OutcomeRequeue)
+	return m.enqueue(d)
+}
+
+// Reply records the reply routed to 'ReplyTo' of the delivery if given, otherwise to 'account_ret'
+func (m *Memory) Reply(d transport.Delivery, reply transport.Reply) error {
+	queue := d.ReplyTo
+	if queue == "" {
+		queue = transport.NameReply
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, Message{queue, reply})
+	return nil
+}
+
+// StopConsuming closes the channel of deliveries. Deliveries in the backlog are still drained through it
+func (m *Memory) StopConsuming() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.stopping {
+		m.stopping = true
+		close(m.deliveries)
+	}
+	return nil
+}
+
+// Close stops consumption
+func (m *Memory) Close() error {
+	return m.StopConsuming()
+}
@@ -0,0 +1,407 @@
+package rabbitmq
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/junzhli/btcd-address-indexing-worker/config"
+	"github.com/junzhli/btcd-address-indexing-worker/logger"
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+	"github.com/streadway/amqp"
+)
+
+const minReconnectDelay = time.Second
+const maxReconnectDelay = 30 * time.Second
+
+const exAccountReqDeadLetter = "account_req_dlx"
+
+const headerRetryCount = "x-retry-count"
+
+// amqpChannel is the part of *amqp.Channel the supervisor works with
+type amqpChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Cancel(consumer string, noWait bool) error
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	NotifyCancel(c chan string) chan string
+	Close() error
+}
+
+// amqpConnection is the part of *amqp.Connection the supervisor works with
+type amqpConnection interface {
+	Close() error
+}
+
+// connectFunc connects to RabbitMQ and starts consuming, which is replaced in tests
+type connectFunc func(config *config.RabbitMQConfig, consumerTag string) (<-chan amqp.Delivery, amqpChannel, amqpConnection, error)
+
+// rabbitMq supervises the connection to RabbitMQ
+// once the connection or channel gets closed unexpectedly, it reconnects with backoff,
+// re-declares the topology and resumes consuming on the same delivery channel
+type rabbitMq struct {
+	config      *config.RabbitMQConfig
+	consumerTag string
+	deliveries  chan transport.Delivery
+	connect     connectFunc
+	// reconnectDelay is the delay before the first attempt to reconnect, which doubles up to maxReconnectDelay
+	reconnectDelay time.Duration
+
+	mu         sync.RWMutex
+	connection amqpConnection
+	channel    amqpChannel
+	stopping   bool
+	closing    bool
+}
+
+// Deliveries returns the channel of deliveries which outlives reconnections
+// It is closed only when the supervisor stops consuming
+func (r *rabbitMq) Deliveries() <-chan transport.Delivery {
+	return r.deliveries
+}
+
+// Ack acknowledges the delivery
+func (r *rabbitMq) Ack(d transport.Delivery) error {
+	return d.Tag.(amqp.Delivery).Ack(false)
+}
+
+// Retry republishes the message to queue 'account_req' with retry count increased and then acknowledges the delivery
+// The delivery is requeued as it is if the republish fails
+func (r *rabbitMq) Retry(d transport.Delivery) error {
+	delivery := d.Tag.(amqp.Delivery)
+	headers := amqp.Table{}
+	for key, val := range delivery.Headers {
+		headers[key] = val
+	}
+	headers[headerRetryCount] = int32(d.RetryCount + 1)
+
+	err := r.publish("", transport.NameRequest, republishing(delivery, headers))
+	if err != nil {
+		logger.LogOnError(err, "Failed to republish the message for retry... requeue it as it is")
+		return delivery.Nack(false, true)
+	}
+	return delivery.Ack(false)
+}
+
+// Nack requeues the delivery, or dead-letters it through exchange 'account_req_dlx' to queue 'account_req_quarantine'
+// Messages are dead-lettered by the worker itself rather than by arguments of queue 'account_req',
+// which is declared without arguments as deployed already
+func (r *rabbitMq) Nack(d transport.Delivery, requeue bool) error {
+	delivery := d.Tag.(amqp.Delivery)
+	if requeue {
+		return delivery.Nack(false, true)
+	}
+
+	err := r.publish(exAccountReqDeadLetter, "", republishing(delivery, delivery.Headers))
+	if err != nil {
+		logger.LogOnError(err, "Failed to dead-letter the message... requeue it as it is")
+		return delivery.Nack(false, true)
+	}
+	return delivery.Ack(false)
+}
+
+// republishing copies the delivery into a message with the headers
+func republishing(delivery amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Expiration:      delivery.Expiration,
+		Timestamp:       delivery.Timestamp,
+		Body:            delivery.Body,
+	}
+}
+
+// Reply publishes the reply to the queue specified with 'ReplyTo' of the delivery
+// otherwise it falls back to the fanout exchange 'account_ret'
+func (r *rabbitMq) Reply(d transport.Delivery, reply transport.Reply) error {
+	exchange := transport.NameReply
+	routingKey := ""
+	if d.ReplyTo != "" {
+		exchange = ""
+		routingKey = d.ReplyTo
+	}
+
+	return r.publish(
+		exchange,
+		routingKey,
+		amqp.Publishing{
+			ContentType:     reply.ContentType,
+			ContentEncoding: reply.ContentEncoding,
+			CorrelationId:   reply.CorrelationID,
+			Body:            reply.Body,
+		},
+	)
+}
+
+// publish publishes the message over the current channel
+func (r *rabbitMq) publish(exchange, key string, msg amqp.Publishing) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.channel.Publish(exchange, key, false, false, msg)
+}
+
+// StopConsuming cancels the consumer so that no more messages are delivered
+// Deliveries already received are still drained through the delivery channel, which is closed afterwards
+func (r *rabbitMq) StopConsuming() error {
+	r.mu.Lock()
+	r.stopping = true
+	channel := r.channel
+	r.mu.Unlock()
+	return channel.Cancel(r.consumerTag, false)
+}
+
+// Close stops the supervision and closes the current channel and connection
+func (r *rabbitMq) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closing {
+		return nil
+	}
+	r.closing = true
+	r.channel.Close()
+	return r.connection.Close()
+}
+
+// isStopped tells whether the supervisor is no longer supposed to consume
+func (r *rabbitMq) isStopped() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.stopping || r.closing
+}
+
+// supervise forwards deliveries of the current channel and reconnects whenever the channel is closed
+// or the consumer is cancelled by RabbitMQ, e.g. as the queue is deleted, while the channel stays open
+func (r *rabbitMq) supervise(receiver <-chan amqp.Delivery) {
+	for {
+		r.mu.RLock()
+		closed := r.channel.NotifyClose(make(chan *amqp.Error, 1))
+		cancelled := r.channel.NotifyCancel(make(chan string, 1))
+		r.mu.RUnlock()
+
+		for d := range receiver {
+			r.deliveries <- newDelivery(d)
+		}
+
+		if r.isStopped() {
+			close(r.deliveries)
+			return
+		}
+		select {
+		case reason := <-closed:
+			if reason != nil {
+				log.Printf("Channel over RabbitMQ is closed: %s", reason)
+			}
+		case tag := <-cancelled:
+			log.Printf("Consumer %s is cancelled by RabbitMQ", tag)
+		}
+		receiver = r.reconnect()
+		if receiver == nil {
+			close(r.deliveries)
+			return
+		}
+	}
+}
+
+// reconnect re-establishes connection with exponential backoff until it succeeds or the supervisor is closed
+func (r *rabbitMq) reconnect() <-chan amqp.Delivery {
+	// the connection may still be alive if only the channel is closed
+	r.mu.RLock()
+	r.connection.Close()
+	r.mu.RUnlock()
+
+	delay := r.reconnectDelay
+	for {
+		log.Printf("Reconnecting to RabbitMQ in %s...", delay)
+		time.Sleep(delay)
+		if r.isStopped() {
+			return nil
+		}
+
+		receiver, channel, connection, err := r.connect(r.config, r.consumerTag)
+		if err == nil {
+			r.mu.Lock()
+			if r.stopping || r.closing {
+				r.mu.Unlock()
+				connection.Close()
+				return nil
+			}
+			r.connection = connection
+			r.channel = channel
+			r.mu.Unlock()
+			log.Printf("Reconnected to RabbitMQ and resumed consuming")
+			return receiver
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// newDelivery converts the delivery from RabbitMQ to transport.Delivery
+func newDelivery(d amqp.Delivery) transport.Delivery {
+	delivery := transport.Delivery{
+		Body:            d.Body,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		CorrelationID:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Timestamp:       d.Timestamp,
+		Tag:             d,
+	}
+
+	if expiration, err := strconv.ParseInt(d.Expiration, 10, 64); err == nil {
+		delivery.Expiration = time.Duration(expiration) * time.Millisecond
+	}
+
+	switch count := d.Headers[headerRetryCount].(type) {
+	case int32:
+		delivery.RetryCount = int(count)
+	case int64:
+		delivery.RetryCount = int(count)
+	}
+	return delivery
+}
+
+// New connects to RabbitMQ and starts consuming queue 'account_req' under supervision
+// Once the connection or channel gets closed unexpectedly, it reconnects with backoff
+func New(config *config.RabbitMQConfig) (transport.Transport, error) {
+	consumerTag := "btcd-address-indexing-worker-" + strconv.Itoa(os.Getpid())
+	receiver, channel, connection, err := connectRabbitMq(config, consumerTag)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rabbitMq{
+		config:         config,
+		consumerTag:    consumerTag,
+		deliveries:     make(chan transport.Delivery),
+		connect:        connectRabbitMq,
+		reconnectDelay: minReconnectDelay,
+		connection:     connection,
+		channel:        channel,
+	}
+	go r.supervise(receiver)
+	return r, nil
+}
+
+// connectRabbitMq connects to RabbitMQ, declares the topology and starts consuming queue 'account_req'
+func connectRabbitMq(config *config.RabbitMQConfig, consumerTag string) (<-chan amqp.Delivery, amqpChannel, amqpConnection, error) {
+	connection, err := amqp.Dial("amqp://" + config.GetConnectionString())
+	if err != nil {
+		logger.LogOnError(err, "An error has occurred when RabbitMQ gets connected")
+		return nil, nil, nil, err
+	}
+
+	channel, err := connection.Channel()
+	if err != nil {
+		logger.LogOnError(err, "Failed to create a channel over RabbitMQ")
+		connection.Close()
+		return nil, nil, nil, err
+	}
+
+	err = channel.ExchangeDeclare(
+		exAccountReqDeadLetter,
+		amqp.ExchangeFanout,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		logger.LogOnError(err, "Failed to declare a dead-letter exchange with name 'account_req_dlx'")
+		connection.Close()
+		return nil, nil, nil, err
+	}
+
+	_, err = channel.QueueDeclare(
+		transport.NameQuarantine,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		logger.LogOnError(err, "Failed to declare a queue with name 'account_req_quarantine'")
+		connection.Close()
+		return nil, nil, nil, err
+	}
+
+	err = channel.QueueBind(
+		transport.NameQuarantine,
+		"",
+		exAccountReqDeadLetter,
+		false,
+		nil,
+	)
+	if err != nil {
+		logger.LogOnError(err, "Failed to bind queue 'account_req_quarantine' to exchange 'account_req_dlx'")
+		connection.Close()
+		return nil, nil, nil, err
+	}
+
+	queue, err := channel.QueueDeclare(
+		transport.NameRequest,
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		logger.LogOnError(err, "Failed to declare a queue with name 'account_req'")
+		connection.Close()
+		return nil, nil, nil, err
+	}
+
+	err = channel.Qos(
+		config.Prefetch,
+		0,
+		false,
+	)
+	if err != nil {
+		logger.LogOnError(err, "Failed to set prefetch count over RabbitMQ")
+		connection.Close()
+		return nil, nil, nil, err
+	}
+
+	receiverQueue, err := channel.Consume(
+		queue.Name,
+		consumerTag,
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		logger.LogOnError(err, "Failed to register a consumer serving queue 'account_req'")
+		connection.Close()
+		return nil, nil, nil, err
+	}
+
+	err = channel.ExchangeDeclare(
+		transport.NameReply,
+		amqp.ExchangeFanout,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		logger.LogOnError(err, "Failed to register a responder channel for 'account_ret'")
+		connection.Close()
+		return nil, nil, nil, err
+	}
+
+	return receiverQueue, channel, connection, nil
+}
@@ -0,0 +1,278 @@
+package rabbitmq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/junzhli/btcd-address-indexing-worker/config"
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+	"github.com/streadway/amqp"
+)
+
+type published struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
+}
+
+// fakeChannel records messages published over it
+// and notifies the supervisor through closed and cancelled if they are given
+type fakeChannel struct {
+	published []published
+	err       error
+	closed    chan *amqp.Error
+	cancelled chan string
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.published = append(c.published, published{exchange, key, msg})
+	return nil
+}
+
+func (c *fakeChannel) Cancel(consumer string, noWait bool) error {
+	return nil
+}
+
+func (c *fakeChannel) NotifyClose(ch chan *amqp.Error) chan *amqp.Error {
+	if c.closed != nil {
+		return c.closed
+	}
+	return ch
+}
+
+func (c *fakeChannel) NotifyCancel(ch chan string) chan string {
+	if c.cancelled != nil {
+		return c.cancelled
+	}
+	return ch
+}
+
+func (c *fakeChannel) Close() error {
+	return nil
+}
+
+// fakeConnection records whether it is closed
+type fakeConnection struct {
+	closed bool
+}
+
+func (c *fakeConnection) Close() error {
+	c.closed = true
+	return nil
+}
+
+// fakeConsumer is what a connection attempt results in
+type fakeConsumer struct {
+	receiver   chan amqp.Delivery
+	channel    *fakeChannel
+	connection *fakeConnection
+	err        error
+}
+
+func newFakeConsumer() *fakeConsumer {
+	return &fakeConsumer{
+		receiver:   make(chan amqp.Delivery),
+		channel:    &fakeChannel{closed: make(chan *amqp.Error, 1), cancelled: make(chan string, 1)},
+		connection: &fakeConnection{},
+	}
+}
+
+// newSupervisedRabbitMq supervises the consumer, and connection attempts afterwards result in the consumers sent to attempts in order
+func newSupervisedRabbitMq(consumer *fakeConsumer, attempts <-chan *fakeConsumer) *rabbitMq {
+	r := &rabbitMq{
+		consumerTag:    "consumer",
+		deliveries:     make(chan transport.Delivery),
+		reconnectDelay: time.Millisecond,
+		connection:     consumer.connection,
+		channel:        consumer.channel,
+		connect: func(config *config.RabbitMQConfig, consumerTag string) (<-chan amqp.Delivery, amqpChannel, amqpConnection, error) {
+			c := <-attempts
+			if c.err != nil {
+				return nil, nil, nil, c.err
+			}
+			return c.receiver, c.channel, c.connection, nil
+		},
+	}
+	go r.supervise(consumer.receiver)
+	return r
+}
+
+// expectDelivery sends the message over the consumer and expects it forwarded by the supervisor
+func expectDelivery(t *testing.T, r *rabbitMq, consumer *fakeConsumer, correlationID string) {
+	t.Helper()
+	go func() {
+		consumer.receiver <- amqp.Delivery{CorrelationId: correlationID}
+	}()
+	select {
+	case d := <-r.Deliveries():
+		if d.CorrelationID != correlationID {
+			t.Fatalf("Expected delivery %s, got %+v", correlationID, d)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Delivery %s is not forwarded", correlationID)
+	}
+}
+
+// expectDeliveriesClosed expects the supervisor to close the delivery channel
+func expectDeliveriesClosed(t *testing.T, r *rabbitMq) {
+	t.Helper()
+	select {
+	case d, ok := <-r.Deliveries():
+		if ok {
+			t.Fatalf("Unexpected delivery %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Deliveries are not closed")
+	}
+}
+
+// fakeAcknowledger records how the delivery is settled
+type fakeAcknowledger struct {
+	settled []string
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.settled = append(a.settled, "ack")
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		a.settled = append(a.settled, "requeue")
+	} else {
+		a.settled = append(a.settled, "nack")
+	}
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func newTestDelivery(retryCount int32) (transport.Delivery, *fakeAcknowledger) {
+	ack := &fakeAcknowledger{}
+	d := amqp.Delivery{
+		Acknowledger:  ack,
+		DeliveryTag:   1,
+		Headers:       amqp.Table{headerRetryCount: retryCount, "x-origin": "service"},
+		ContentType:   "application/json",
+		CorrelationId: "req-1",
+		ReplyTo:       "amq.rabbitmq.reply-to",
+		Expiration:    "60000",
+		Timestamp:     time.Unix(1600000000, 0),
+		Body:          []byte(`{"account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","task":"balance"}`),
+	}
+	return newDelivery(d), ack
+}
+
+func TestNewDelivery(t *testing.T) {
+	d, _ := newTestDelivery(2)
+	if d.RetryCount != 2 || d.Expiration != time.Minute || d.CorrelationID != "req-1" || d.ReplyTo != "amq.rabbitmq.reply-to" {
+		t.Errorf("Unexpected delivery %+v", d)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	channel := &fakeChannel{}
+	r := &rabbitMq{channel: channel}
+	d, ack := newTestDelivery(1)
+
+	if err := r.Retry(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(channel.published) != 1 || len(ack.settled) != 1 || ack.settled[0] != "ack" {
+		t.Fatalf("Expected the message republished and acked, got %v %v", channel.published, ack.settled)
+	}
+	p := channel.published[0]
+	if p.exchange != "" || p.key != transport.NameRequest || p.msg.Headers[headerRetryCount] != int32(2) ||
+		p.msg.Headers["x-origin"] != "service" || p.msg.CorrelationId != "req-1" || string(p.msg.Body) != string(d.Body) {
+		t.Errorf("Unexpected message republished %+v", p)
+	}
+}
+
+func TestNack(t *testing.T) {
+	channel := &fakeChannel{}
+	r := &rabbitMq{channel: channel}
+
+	d, ack := newTestDelivery(0)
+	if err := r.Nack(d, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(channel.published) != 0 || len(ack.settled) != 1 || ack.settled[0] != "requeue" {
+		t.Errorf("Expected the delivery requeued, got %v %v", channel.published, ack.settled)
+	}
+
+	// dead-lettered by the worker itself
+	d, ack = newTestDelivery(3)
+	if err := r.Nack(d, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(channel.published) != 1 || len(ack.settled) != 1 || ack.settled[0] != "ack" {
+		t.Fatalf("Expected the message dead-lettered and acked, got %v %v", channel.published, ack.settled)
+	}
+	p := channel.published[0]
+	if p.exchange != exAccountReqDeadLetter || p.msg.Headers[headerRetryCount] != int32(3) || string(p.msg.Body) != string(d.Body) {
+		t.Errorf("Unexpected message dead-lettered %+v", p)
+	}
+
+	// nothing is lost if the dead-letter exchange is unreachable
+	channel.err = errors.New("channel/connection is not open")
+	d, ack = newTestDelivery(3)
+	if err := r.Nack(d, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(ack.settled) != 1 || ack.settled[0] != "requeue" {
+		t.Errorf("Expected the delivery requeued, got %v", ack.settled)
+	}
+}
+
+func TestSuperviseReconnect(t *testing.T) {
+	first, second, third := newFakeConsumer(), newFakeConsumer(), newFakeConsumer()
+	attempts := make(chan *fakeConsumer, 3)
+	r := newSupervisedRabbitMq(first, attempts)
+	expectDelivery(t, r, first, "req-1")
+
+	// the consumer is cancelled by RabbitMQ while the channel stays open
+	attempts <- &fakeConsumer{err: errors.New("connection refused")}
+	attempts <- second
+	first.channel.cancelled <- r.consumerTag
+	close(first.receiver)
+	expectDelivery(t, r, second, "req-2")
+	if !first.connection.closed {
+		t.Error("Expected the previous connection closed")
+	}
+
+	// the channel is closed
+	attempts <- third
+	second.channel.closed <- &amqp.Error{Code: amqp.ChannelError, Reason: "NOT_FOUND"}
+	close(second.receiver)
+	expectDelivery(t, r, third, "req-3")
+
+	if err := r.StopConsuming(); err != nil {
+		t.Fatal(err)
+	}
+	close(third.receiver)
+	expectDeliveriesClosed(t, r)
+	if len(attempts) != 0 {
+		t.Errorf("Unexpected connection attempts left %d", len(attempts))
+	}
+}
+
+func TestSuperviseCloseWhileReconnecting(t *testing.T) {
+	consumer := newFakeConsumer()
+	attempts := make(chan *fakeConsumer)
+	r := newSupervisedRabbitMq(consumer, attempts)
+
+	consumer.channel.closed <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"}
+	close(consumer.receiver)
+	attempts <- &fakeConsumer{err: errors.New("connection refused")}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectDeliveriesClosed(t, r)
+}
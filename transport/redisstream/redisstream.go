@@ -0,0 +1,280 @@
+package redisstream
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/junzhli/btcd-address-indexing-worker/logger"
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+)
+
+// Fields of stream entries
+const (
+	FieldBody            = "body"
+	FieldContentType     = "contentType"
+	FieldContentEncoding = "contentEncoding"
+	FieldCorrelationID   = "correlationId"
+	FieldReplyTo         = "replyTo"
+	FieldTimestamp       = "timestamp"  // unix time in milliseconds
+	FieldExpiration      = "expiration" // milliseconds
+	FieldRetryCount      = "retryCount"
+)
+
+// replies are trimmed to approximately the length on stream 'account_ret'
+const maxReplyLen = 100000
+
+const readBlock = time.Second
+const retryDelay = time.Second
+
+// claimScanCount is the max number of pending entries of the group looked up at once for claiming
+const claimScanCount = 100
+
+// redisStream consumes stream 'account_req' as a member of the consumer group
+// Entries left pending by a previous run of the same consumer are served again before new ones,
+// and those left pending by other consumers for longer than claimIdle are claimed
+type redisStream struct {
+	client     *redis.Client
+	group      string
+	consumer   string
+	count      int64
+	claimIdle  time.Duration
+	deliveries chan transport.Delivery
+
+	mu       sync.RWMutex
+	stopping bool
+}
+
+// Deliveries returns the channel of deliveries, which is closed once consumption stops
+func (r *redisStream) Deliveries() <-chan transport.Delivery {
+	return r.deliveries
+}
+
+// Ack acknowledges the entry to the consumer group
+func (r *redisStream) Ack(d transport.Delivery) error {
+	return r.client.XAck(transport.NameRequest, r.group, d.Tag.(string)).Err()
+}
+
+// Retry appends the entry to stream 'account_req' again with retry count increased and then acknowledges the entry
+func (r *redisStream) Retry(d transport.Delivery) error {
+	values := entryValues(d)
+	values[FieldRetryCount] = strconv.Itoa(d.RetryCount + 1)
+	return r.move(d, transport.NameRequest, values)
+}
+
+// Nack appends the entry to stream 'account_req' again with requeue so that it is served by any consumer,
+// otherwise it moves the entry to stream 'account_req_quarantine'
+func (r *redisStream) Nack(d transport.Delivery, requeue bool) error {
+	if requeue {
+		return r.move(d, transport.NameRequest, entryValues(d))
+	}
+	return r.move(d, transport.NameQuarantine, entryValues(d))
+}
+
+// move appends the values to the stream and then acknowledges the entry
+// The entry is left pending if it fails to append, which is served again on restart or claimed once idle
+func (r *redisStream) move(d transport.Delivery, stream string, values map[string]interface{}) error {
+	err := r.client.XAdd(&redis.XAddArgs{
+		Stream: stream,
+		Values: values,
+	}).Err()
+	if err != nil {
+		return err
+	}
+	return r.Ack(d)
+}
+
+// Reply appends the reply to the stream specified with 'ReplyTo' of the delivery
+// otherwise it falls back to stream 'account_ret'
+func (r *redisStream) Reply(d transport.Delivery, reply transport.Reply) error {
+	stream := transport.NameReply
+	if d.ReplyTo != "" {
+		stream = d.ReplyTo
+	}
+
+	return r.client.XAdd(&redis.XAddArgs{
+		Stream:       stream,
+		MaxLenApprox: maxReplyLen,
+		Values: map[string]interface{}{
+			FieldBody:            reply.Body,
+			FieldContentType:     reply.ContentType,
+			FieldContentEncoding: reply.ContentEncoding,
+			FieldCorrelationID:   reply.CorrelationID,
+		},
+	}).Err()
+}
+
+// StopConsuming stops reading new entries from the stream
+func (r *redisStream) StopConsuming() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopping = true
+	return nil
+}
+
+// Close stops consuming and closes the client
+func (r *redisStream) Close() error {
+	r.StopConsuming()
+	return r.client.Close()
+}
+
+func (r *redisStream) isStopped() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.stopping
+}
+
+// consume reads entries pending on the consumer from the beginning, and then new entries of the stream
+// along with entries claimed from other consumers, which are looked up every half of claimIdle
+func (r *redisStream) consume() {
+	defer close(r.deliveries)
+	lastID := "0"
+	lastClaim := time.Time{}
+	for !r.isStopped() {
+		if lastID == ">" && time.Since(lastClaim) >= r.claimIdle/2 {
+			r.claim()
+			lastClaim = time.Now()
+		}
+
+		streams, err := r.client.XReadGroup(&redis.XReadGroupArgs{
+			Group:    r.group,
+			Consumer: r.consumer,
+			Streams:  []string{transport.NameRequest, lastID},
+			Count:    r.count,
+			Block:    readBlock,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			logger.LogOnError(err, "Failed to read entries from stream 'account_req'")
+			time.Sleep(retryDelay)
+			continue
+		}
+
+		for _, stream := range streams {
+			if lastID != ">" && len(stream.Messages) == 0 {
+				// all pending entries have been served
+				lastID = ">"
+			}
+			for _, msg := range stream.Messages {
+				if lastID != ">" {
+					lastID = msg.ID
+				}
+				r.deliveries <- newDelivery(msg)
+			}
+		}
+	}
+}
+
+// claim takes over entries pending on other consumers of the group for longer than claimIdle,
+// which are left behind by consumers crashed or gone for good
+func (r *redisStream) claim() {
+	pending, err := r.client.XPendingExt(&redis.XPendingExtArgs{
+		Stream: transport.NameRequest,
+		Group:  r.group,
+		Start:  "-",
+		End:    "+",
+		Count:  claimScanCount,
+	}).Result()
+	if err != nil {
+		logger.LogOnError(err, "Failed to look up pending entries of stream 'account_req'")
+		return
+	}
+
+	ids := make([]string, 0)
+	for _, entry := range pending {
+		// entries pending on the consumer itself are in flight
+		if entry.Consumer != r.consumer && entry.Idle >= r.claimIdle {
+			ids = append(ids, entry.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	msgs, err := r.client.XClaim(&redis.XClaimArgs{
+		Stream:   transport.NameRequest,
+		Group:    r.group,
+		Consumer: r.consumer,
+		MinIdle:  r.claimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		logger.LogOnError(err, "Failed to claim idle entries of stream 'account_req'")
+		return
+	}
+	for _, msg := range msgs {
+		r.deliveries <- newDelivery(msg)
+	}
+}
+
+// entryValues restores fields of the entry from the delivery
+func entryValues(d transport.Delivery) map[string]interface{} {
+	values := map[string]interface{}{
+		FieldBody:            d.Body,
+		FieldContentType:     d.ContentType,
+		FieldContentEncoding: d.ContentEncoding,
+		FieldCorrelationID:   d.CorrelationID,
+		FieldReplyTo:         d.ReplyTo,
+		FieldRetryCount:      strconv.Itoa(d.RetryCount),
+	}
+	if !d.Timestamp.IsZero() {
+		values[FieldTimestamp] = strconv.FormatInt(d.Timestamp.UnixNano()/int64(time.Millisecond), 10)
+	}
+	if d.Expiration != 0 {
+		values[FieldExpiration] = strconv.FormatInt(int64(d.Expiration/time.Millisecond), 10)
+	}
+	return values
+}
+
+// newDelivery converts the entry of the stream to transport.Delivery
+func newDelivery(msg redis.XMessage) transport.Delivery {
+	field := func(name string) string {
+		val, _ := msg.Values[name].(string)
+		return val
+	}
+
+	d := transport.Delivery{
+		Body:            []byte(field(FieldBody)),
+		ContentType:     field(FieldContentType),
+		ContentEncoding: field(FieldContentEncoding),
+		CorrelationID:   field(FieldCorrelationID),
+		ReplyTo:         field(FieldReplyTo),
+		Tag:             msg.ID,
+	}
+	if timestamp, err := strconv.ParseInt(field(FieldTimestamp), 10, 64); err == nil {
+		d.Timestamp = time.Unix(0, timestamp*int64(time.Millisecond))
+	}
+	if expiration, err := strconv.ParseInt(field(FieldExpiration), 10, 64); err == nil {
+		d.Expiration = time.Duration(expiration) * time.Millisecond
+	}
+	if count, err := strconv.Atoi(field(FieldRetryCount)); err == nil {
+		d.RetryCount = count
+	}
+	return d
+}
+
+// New joins the consumer group of stream 'account_req' and starts consuming
+// count limits the number of entries read at once, and entries pending on other consumers are claimed once idle for claimIdle
+func New(options *redis.Options, group string, consumer string, count int64, claimIdle time.Duration) (transport.Transport, error) {
+	client := redis.NewClient(options)
+	err := client.XGroupCreateMkStream(transport.NameRequest, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		client.Close()
+		return nil, err
+	}
+
+	r := &redisStream{
+		client:     client,
+		group:      group,
+		consumer:   consumer,
+		count:      count,
+		claimIdle:  claimIdle,
+		deliveries: make(chan transport.Delivery),
+	}
+	go r.consume()
+	return r, nil
+}
@@ -0,0 +1,363 @@
+package redisstream
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+)
+
+const (
+	testGroup    = "btcd-address-indexing-worker"
+	testConsumer = "worker-1"
+)
+
+type fakeEntry struct {
+	id     string
+	values []string
+}
+
+type fakePending struct {
+	consumer  string
+	delivered time.Time
+	count     int64
+}
+
+// fakeRedis serves the subset of stream commands used by the transport over RESP
+// The group reads entries of stream 'account_req' only and XREADGROUP never blocks
+type fakeRedis struct {
+	listener net.Listener
+
+	mu            sync.Mutex
+	seq           int
+	streams       map[string][]fakeEntry
+	lastDelivered int
+	pending       map[string]*fakePending
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		listener: listener,
+		streams:  make(map[string][]fakeEntry),
+		pending:  make(map[string]*fakePending),
+	}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, f.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func array(items []string) string {
+	return "*" + strconv.Itoa(len(items)) + "\r\n" + strings.Join(items, "")
+}
+
+func (e fakeEntry) reply() string {
+	values := make([]string, 0, len(e.values))
+	for _, val := range e.values {
+		values = append(values, bulk(val))
+	}
+	return array([]string{bulk(e.id), array(values)})
+}
+
+func seqOf(id string) int {
+	seq, _ := strconv.Atoi(strings.SplitN(id, "-", 2)[0])
+	return seq
+}
+
+// argAfter returns the nth argument following the keyword
+func argAfter(args []string, keyword string, nth int) string {
+	for i, arg := range args[:len(args)-nth] {
+		if strings.EqualFold(arg, keyword) {
+			return args[i+nth]
+		}
+	}
+	return ""
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "XGROUP":
+		return "+OK\r\n"
+	case "XADD":
+		i := 2
+		if strings.EqualFold(args[i], "maxlen") {
+			i += 2
+			if args[i-1] == "~" {
+				i++
+			}
+		}
+		return bulk(f.add(args[1], args[i+1:]))
+	case "XREADGROUP":
+		return f.readGroup(argAfter(args, "group", 2), args[len(args)-1], argAfter(args, "count", 1))
+	case "XACK":
+		acked := 0
+		for _, id := range args[3:] {
+			if _, ok := f.pending[id]; ok {
+				delete(f.pending, id)
+				acked++
+			}
+		}
+		return ":" + strconv.Itoa(acked) + "\r\n"
+	case "XPENDING":
+		items := make([]string, 0)
+		for _, id := range f.pendingIDs("") {
+			p := f.pending[id]
+			items = append(items, array([]string{
+				bulk(id),
+				bulk(p.consumer),
+				":" + strconv.FormatInt(int64(time.Since(p.delivered)/time.Millisecond), 10) + "\r\n",
+				":" + strconv.FormatInt(p.count, 10) + "\r\n",
+			}))
+		}
+		return array(items)
+	case "XCLAIM":
+		consumer := args[3]
+		minIdle, _ := strconv.Atoi(args[4])
+		items := make([]string, 0)
+		for _, id := range args[5:] {
+			p, ok := f.pending[id]
+			if !ok || time.Since(p.delivered) < time.Duration(minIdle)*time.Millisecond {
+				continue
+			}
+			p.consumer = consumer
+			p.delivered = time.Now()
+			p.count++
+			items = append(items, f.entry(transport.NameRequest, id).reply())
+		}
+		return array(items)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func (f *fakeRedis) add(stream string, values []string) string {
+	f.seq++
+	id := strconv.Itoa(f.seq) + "-0"
+	f.streams[stream] = append(f.streams[stream], fakeEntry{id, values})
+	return id
+}
+
+func (f *fakeRedis) entry(stream string, id string) fakeEntry {
+	for _, e := range f.streams[stream] {
+		if e.id == id {
+			return e
+		}
+	}
+	return fakeEntry{}
+}
+
+// pendingIDs lists ids pending on the consumer, or on all consumers if not given, in order
+func (f *fakeRedis) pendingIDs(consumer string) []string {
+	ids := make([]string, 0)
+	for id, p := range f.pending {
+		if consumer == "" || p.consumer == consumer {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return seqOf(ids[i]) < seqOf(ids[j]) })
+	return ids
+}
+
+func (f *fakeRedis) readGroup(consumer string, lastID string, count string) string {
+	max, _ := strconv.Atoi(count)
+	entries := make([]string, 0)
+	if lastID != ">" {
+		for _, id := range f.pendingIDs(consumer) {
+			if seqOf(id) > seqOf(lastID) && len(entries) < max {
+				entries = append(entries, f.entry(transport.NameRequest, id).reply())
+			}
+		}
+		return array([]string{array([]string{bulk(transport.NameRequest), array(entries)})})
+	}
+
+	stream := f.streams[transport.NameRequest]
+	for f.lastDelivered < len(stream) && len(entries) < max {
+		e := stream[f.lastDelivered]
+		f.pending[e.id] = &fakePending{consumer, time.Now(), 1}
+		entries = append(entries, e.reply())
+		f.lastDelivered++
+	}
+	if len(entries) == 0 {
+		f.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		f.mu.Lock()
+		return "*-1\r\n"
+	}
+	return array([]string{array([]string{bulk(transport.NameRequest), array(entries)})})
+}
+
+// deliver marks new entries as delivered to the consumer as if it has read them
+func (f *fakeRedis) deliver(consumer string, idle time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stream := f.streams[transport.NameRequest]
+	for ; f.lastDelivered < len(stream); f.lastDelivered++ {
+		f.pending[stream[f.lastDelivered].id] = &fakePending{consumer, time.Now().Add(-idle), 1}
+	}
+}
+
+func (f *fakeRedis) snapshot(stream string) ([]fakeEntry, map[string]fakePending) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pending := make(map[string]fakePending)
+	for id, p := range f.pending {
+		pending[id] = *p
+	}
+	return append([]fakeEntry(nil), f.streams[stream]...), pending
+}
+
+func (f *fakeRedis) push(body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.add(transport.NameRequest, []string{FieldBody, body, FieldRetryCount, "0"})
+}
+
+func startTransport(t *testing.T, f *fakeRedis, claimIdle time.Duration) transport.Transport {
+	tr, err := New(&redis.Options{Addr: f.listener.Addr().String()}, testGroup, testConsumer, 10, claimIdle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func receive(t *testing.T, tr transport.Transport) transport.Delivery {
+	select {
+	case d := <-tr.Deliveries():
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a delivery")
+	}
+	return transport.Delivery{}
+}
+
+func TestNackRequeue(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.listener.Close()
+	f.push(`{"account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","task":"balance"}`)
+	tr := startTransport(t, f, time.Hour)
+	defer tr.Close()
+
+	d := receive(t, tr)
+	if err := tr.Nack(d, true); err != nil {
+		t.Fatal(err)
+	}
+	// the entry is appended again instead of being left pending
+	entries, pending := f.snapshot(transport.NameRequest)
+	if _, ok := pending[d.Tag.(string)]; len(entries) != 2 || ok {
+		t.Fatalf("Expected the entry appended again and acknowledged, got %v pending %v", entries, pending)
+	}
+
+	requeued := receive(t, tr)
+	if string(requeued.Body) != string(d.Body) || requeued.Tag == d.Tag || requeued.RetryCount != 0 {
+		t.Errorf("Unexpected requeued delivery %+v", requeued)
+	}
+	if err := tr.Nack(requeued, false); err != nil {
+		t.Fatal(err)
+	}
+	quarantined, pending := f.snapshot(transport.NameQuarantine)
+	if len(quarantined) != 1 || len(pending) != 0 {
+		t.Errorf("Expected the entry quarantined, got %v pending %v", quarantined, pending)
+	}
+}
+
+func TestClaimIdle(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.listener.Close()
+	// left behind by consumers gone for good
+	f.push(`{"account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","task":"balance"}`)
+	f.deliver("worker-2", time.Minute)
+	f.push(`{"account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","task":"all"}`)
+	f.deliver("worker-3", 0)
+	tr := startTransport(t, f, 30*time.Second)
+	defer tr.Close()
+
+	d := receive(t, tr)
+	if !strings.Contains(string(d.Body), `"task":"balance"`) {
+		t.Fatalf("Expected the idle entry claimed, got %s", d.Body)
+	}
+	_, pending := f.snapshot(transport.NameRequest)
+	if p := pending[d.Tag.(string)]; p.consumer != testConsumer || p.count != 2 {
+		t.Errorf("Expected the entry claimed by %s, got %+v", testConsumer, p)
+	}
+	if err := tr.Ack(d); err != nil {
+		t.Fatal(err)
+	}
+
+	// the entry pending on the consumer still alive is left alone
+	select {
+	case d := <-tr.Deliveries():
+		t.Errorf("Unexpected delivery %s", d.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, pending = f.snapshot(transport.NameRequest)
+	if len(pending) != 1 {
+		t.Errorf("Expected one entry left pending, got %v", pending)
+	}
+}
@@ -0,0 +1,52 @@
+package transport
+
+import "time"
+
+// Names of queues/streams shared by transports
+const (
+	NameRequest    = "account_req"
+	NameReply      = "account_ret"
+	NameQuarantine = "account_req_quarantine"
+)
+
+// Delivery is a request received from transport
+// It must be settled with exactly one of Ack, Retry and Nack of the transport it comes from
+type Delivery struct {
+	Body            []byte
+	ContentType     string
+	ContentEncoding string
+	CorrelationID   string
+	ReplyTo         string
+	Timestamp       time.Time
+	Expiration      time.Duration
+	RetryCount      int
+	// Tag is the transport specific handle of the delivery
+	Tag interface{}
+}
+
+// Reply is a message replied to the caller of a delivery
+type Reply struct {
+	ContentType     string
+	ContentEncoding string
+	CorrelationID   string
+	Body            []byte
+}
+
+// Transport delivers requests to the worker and routes replies back to callers
+type Transport interface {
+	// Deliveries returns the channel of deliveries, which is closed once consumption stops
+	Deliveries() <-chan Delivery
+	// Ack settles the delivery as done
+	Ack(d Delivery) error
+	// Retry settles the delivery and redelivers it later with retry count increased
+	Retry(d Delivery) error
+	// Nack settles the delivery as failed. It goes back to the queue with requeue,
+	// otherwise it is dead-lettered to 'account_req_quarantine'
+	Nack(d Delivery, requeue bool) error
+	// Reply routes the reply to 'ReplyTo' of the delivery if given, otherwise to 'account_ret'
+	Reply(d Delivery, reply Reply) error
+	// StopConsuming stops receiving new requests. Deliveries received are still drained through Deliveries
+	StopConsuming() error
+	// Close releases the underlying connection
+	Close() error
+}
@@ -0,0 +1,175 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/junzhli/btcd-address-indexing-worker/account"
+	"github.com/junzhli/btcd-address-indexing-worker/btcd"
+)
+
+// error codes
+const (
+	ErrorCodeBtcdRPC           = "btcd_rpc_error"
+	ErrorCodeBtcdResponse      = "btcd_invalid_response"
+	ErrorCodeBtcdUnavailable   = "btcd_unavailable"
+	ErrorCodeMongo             = "mongo_error"
+	ErrorCodeRedis             = "redis_error"
+	ErrorCodeStateKeyNotFound  = "state_key_not_found"
+	ErrorCodeCorruptedData     = "corrupted_data"
+	ErrorCodeIncompleteHistory = "incomplete_history"
+	ErrorCodeInternal          = "internal_error"
+	ErrorCodeInvalidRequest    = "invalid_request"
+	ErrorCodeUnsupportedTask   = "unsupported_task"
+	ErrorCodeDeadlineExceeded  = "deadline_exceeded"
+)
+
+// errorCodes lists all error codes
+var errorCodes = []string{
+	ErrorCodeBtcdRPC,
+	ErrorCodeBtcdResponse,
+	ErrorCodeBtcdUnavailable,
+	ErrorCodeMongo,
+	ErrorCodeRedis,
+	ErrorCodeStateKeyNotFound,
+	ErrorCodeCorruptedData,
+	ErrorCodeIncompleteHistory,
+	ErrorCodeInternal,
+	ErrorCodeInvalidRequest,
+	ErrorCodeUnsupportedTask,
+	ErrorCodeDeadlineExceeded,
+}
+
+// InvalidRequestError indicates the request message could not be parsed
+type InvalidRequestError struct {
+	Reason string
+}
+
+func (err InvalidRequestError) Error() string {
+	return "Invalid request message: " + err.Reason
+}
+
+// ValidationError indicates the field of the request is missing or malformed
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (err ValidationError) Error() string {
+	return "Invalid field '" + err.Field + "': " + err.Reason
+}
+
+// UnsupportedTaskError indicates the requested task is unknown to the worker
+type UnsupportedTaskError struct {
+	Task string
+}
+
+func (err UnsupportedTaskError) Error() string {
+	return "Unsupported task: " + err.Task
+}
+
+// UnsupportedResultError indicates the result of the type could not be streamed in chunks
+type UnsupportedResultError struct {
+	Type string
+}
+
+func (err UnsupportedResultError) Error() string {
+	return "Unsupported result to stream: " + err.Type
+}
+
+// DeadlineExceededError indicates the request has expired before it is served
+type DeadlineExceededError struct {
+	Deadline time.Time
+}
+
+func (err DeadlineExceededError) Error() string {
+	return "Request expired at " + err.Deadline.Format(time.RFC3339)
+}
+
+// btcd responds with the code while it is still warming up
+const btcdRPCInWarmup = -28
+
+// classifyError maps error returned from the task to error code and tells whether the task is worth a retry
+func classifyError(err error) (string, bool) {
+	var invalidErr InvalidRequestError
+	if errors.As(err, &invalidErr) {
+		return ErrorCodeInvalidRequest, false
+	}
+
+	var validationErr ValidationError
+	if errors.As(err, &validationErr) {
+		return ErrorCodeInvalidRequest, false
+	}
+
+	var pointsErr account.TooManyPointsError
+	if errors.As(err, &pointsErr) {
+		return ErrorCodeInvalidRequest, false
+	}
+
+	var unsupportedErr UnsupportedTaskError
+	if errors.As(err, &unsupportedErr) {
+		return ErrorCodeUnsupportedTask, false
+	}
+
+	var deadlineErr DeadlineExceededError
+	if errors.As(err, &deadlineErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ErrorCodeDeadlineExceeded, false
+	}
+
+	var stateErr account.StateKeyNotFoundError
+	if errors.As(err, &stateErr) {
+		return ErrorCodeStateKeyNotFound, false
+	}
+
+	var corruptedErr account.CorruptedDataError
+	if errors.As(err, &corruptedErr) {
+		return ErrorCodeCorruptedData, false
+	}
+
+	var incompleteErr account.IncompleteHistoryError
+	if errors.As(err, &incompleteErr) {
+		return ErrorCodeIncompleteHistory, false
+	}
+
+	var rpcErr btcd.JSONRPCError
+	if errors.As(err, &rpcErr) {
+		return ErrorCodeBtcdRPC, rpcErr.Code == btcdRPCInWarmup
+	}
+
+	var respErr btcd.InvalidResponseCodeError
+	if errors.As(err, &respErr) {
+		return ErrorCodeBtcdResponse, respErr.Code >= 500
+	}
+
+	var backendErr account.BackendError
+	if errors.As(err, &backendErr) {
+		switch backendErr.Backend {
+		case account.BackendBtcd:
+			return ErrorCodeBtcdUnavailable, true
+		case account.BackendMongo:
+			return ErrorCodeMongo, true
+		case account.BackendRedis:
+			return ErrorCodeRedis, true
+		}
+	}
+
+	return ErrorCodeInternal, false
+}
+
+// newResponseError wraps the error into the envelope replied to the caller
+func newResponseError(base responseBase, err error) responseError {
+	code, retryable := classifyError(err)
+	base.Status = StatusError
+	detail := errorDetail{
+		Code:      code,
+		Message:   err.Error(),
+		Retryable: retryable,
+	}
+
+	var validationErr ValidationError
+	if errors.As(err, &validationErr) {
+		detail.Field = validationErr.Field
+	}
+	return responseError{base, detail}
+}
@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/junzhli/btcd-address-indexing-worker/account"
+	"github.com/junzhli/btcd-address-indexing-worker/codec"
+	"github.com/junzhli/btcd-address-indexing-worker/logger"
+)
+
+const httpPathAddress = "/address/"
+const httpHeaderRequestID = "X-Request-Id"
+
+// NewHTTPHandler serves the same tasks as the consumer does over HTTP/JSON
+//
+// GET /address/{addr}/balance
+// GET /address/{addr}/transactions
+// GET /address/{addr}/unspents
+// GET /address/{addr}/all
+// GET /address/{addr}/history
+// GET /address/{addr}/balanceAt
+// GET /address/{addr}/balanceSeries
+//
+// Commands 'transactions', 'unspents' and 'history' take query parameters 'offset', 'limit' and 'cursor'
+// Balances are in units of query parameter 'units'
+// Query parameter 'minConfirmations' counts only transactions confirmed at least the times
+// Command 'balanceAt' takes query parameter 'height' or 'timestamp' in RFC 3339
+// Command 'balanceSeries' takes query parameters 'interval', 'from' and 'to' in RFC 3339
+// Responses are encoded in MessagePack if asked by header 'Accept', and compressed if allowed by header 'Accept-Encoding'
+
+func NewHTTPHandler(config *account.Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(httpPathAddress, func(w http.ResponseWriter, r *http.Request) {
+		serveAddress(w, r, config)
+	})
+	return mux
+}
+
+func serveAddress(w http.ResponseWriter, r *http.Request, config *account.Config) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := strings.Split(strings.TrimPrefix(r.URL.Path, httpPathAddress), "/")
+	if len(params) != 2 || params[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	lg := log.New(os.Stdout, "[HTTP "+r.RemoteAddr+"] ", log.LstdFlags)
+	lg2 := logger.New(lg)
+	acout := account.New(lg, lg2, config)
+	base := responseBase{
+		Version:   SchemaVersion,
+		Command:   params[1],
+		Account:   params[0],
+		RequestID: r.Header.Get(httpHeaderRequestID),
+		Status:    StatusOK,
+	}
+	lg.Printf("Task is requested with parameters: addr => " + base.Account + " task => " + base.Command + " requestId => " + base.RequestID)
+
+	status := http.StatusOK
+	var result interface{}
+	req, err := httpRequest(r, base)
+	if err == nil {
+		var opts taskOptions
+		opts, err = validateRequest(req)
+		if err == nil {
+			result, err = runTask(r.Context(), acout, base, opts)
+		}
+	}
+	if err != nil {
+		lg2.LogOnError(err, "Fails on the task")
+		resErr := newResponseError(base, err)
+		status = httpStatus(resErr.Error)
+		result = resErr
+	}
+
+	enc := httpEncoding(r)
+	res, err := enc.encode(result)
+	if err != nil {
+		lg2.LogOnError(err, "Failed to output the result for the task")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", enc.codec.ContentType())
+	if enc.contentEncoding != "" {
+		w.Header().Set("Content-Encoding", enc.contentEncoding)
+	}
+	w.Header().Add("Vary", "Accept, Accept-Encoding")
+	w.WriteHeader(status)
+	_, err = w.Write(res)
+	lg2.LogOnError(err, "Failed to write the result for the task")
+}
+
+// httpRequest builds the request from the path and query parameters
+func httpRequest(r *http.Request, base responseBase) (request, error) {
+	query := r.URL.Query()
+	req := request{
+		Account: base.Account,
+		Task:    base.Command,
+		Cursor:  query.Get("cursor"),
+		Units:   query.Get("units"),
+	}
+
+	var err error
+	if v := query.Get("minConfirmations"); v != "" {
+		req.MinConfirmations, err = strconv.Atoi(v)
+		if err != nil {
+			return request{}, ValidationError{Field: "minConfirmations", Reason: "must be an integer"}
+		}
+	}
+	if v := query.Get("height"); v != "" {
+		height, err := strconv.Atoi(v)
+		if err != nil {
+			return request{}, ValidationError{Field: "height", Reason: "must be an integer"}
+		}
+		req.Height = &height
+	}
+	if v := query.Get("timestamp"); v != "" {
+		timestamp, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return request{}, ValidationError{Field: "timestamp", Reason: "must be in RFC 3339"}
+		}
+		req.Timestamp = &timestamp
+	}
+	req.Interval = query.Get("interval")
+	if v := query.Get("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return request{}, ValidationError{Field: "from", Reason: "must be in RFC 3339"}
+		}
+		req.From = &from
+	}
+	if v := query.Get("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return request{}, ValidationError{Field: "to", Reason: "must be in RFC 3339"}
+		}
+		req.To = &to
+	}
+	if v := query.Get("offset"); v != "" {
+		req.Offset, err = strconv.Atoi(v)
+		if err != nil {
+			return request{}, ValidationError{Field: "offset", Reason: "must be an integer"}
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		req.Limit, err = strconv.Atoi(v)
+		if err != nil {
+			return request{}, ValidationError{Field: "limit", Reason: "must be an integer"}
+		}
+	}
+	return req, nil
+}
+
+// httpEncoding negotiates the encoding of the response with headers of the request, which falls back to JSON
+func httpEncoding(r *http.Request) replyEncoding {
+	enc := replyEncoding{codec: codec.ForContentType(codec.ContentTypeJSON)}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if c := codec.ForContentType(accept); c.ContentType() != codec.ContentTypeText {
+			enc.codec = c
+			break
+		}
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.Split(accept, ";")[0]) == codec.EncodingGzip {
+			enc.contentEncoding = codec.EncodingGzip
+			break
+		}
+	}
+	return enc
+}
+
+// httpStatus maps error envelope to HTTP status code
+func httpStatus(detail errorDetail) int {
+	switch detail.Code {
+	case ErrorCodeUnsupportedTask:
+		return http.StatusNotFound
+	case ErrorCodeInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorCodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+
+	if detail.Retryable {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
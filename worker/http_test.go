@@ -0,0 +1,237 @@
+package worker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/golang/mock/gomock"
+	"github.com/junzhli/btcd-address-indexing-worker/account"
+	mockBtcd "github.com/junzhli/btcd-address-indexing-worker/btcd/mocks"
+	"github.com/junzhli/btcd-address-indexing-worker/codec"
+	mockMongo "github.com/junzhli/btcd-address-indexing-worker/mongo/mocks"
+	rs "github.com/junzhli/btcd-address-indexing-worker/redis"
+	mockRedis "github.com/junzhli/btcd-address-indexing-worker/redis/mocks"
+	"github.com/junzhli/btcd-address-indexing-worker/redis/utils"
+	"github.com/junzhli/btcd-address-indexing-worker/worker"
+)
+
+// httpError is the error envelope replied over HTTP
+type httpError struct {
+	Command string `json:"command"`
+	Status  string `json:"status"`
+	Error   struct {
+		Code      string `json:"code"`
+		Retryable bool   `json:"retryable"`
+	} `json:"error"`
+}
+
+func serveHTTP(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestHTTPBalance(t *testing.T) {
+	config, _, mockCtrl := newHarness(t)
+	defer mockCtrl.Finish()
+
+	r := httptest.NewRequest(http.MethodGet, "/address/"+address+"/balance?units=satoshi", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	w := serveHTTP(worker.NewHTTPHandler(config.Account), r)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != codec.ContentTypeJSON {
+		t.Fatalf("Unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	expected := `{"version":1,"command":"balance","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-1","status":"ok",` +
+		`"data":160720958,"balanceBtc":"1.60720958","confirmed":160720958,"unconfirmed":0,"pending":{"incoming":[],"outgoing":[]}}`
+	if body := w.Body.String(); body != expected {
+		t.Errorf("Unexpected response\nexpected: %s\ngot:      %s", expected, body)
+	}
+}
+
+func TestHTTPEncoding(t *testing.T) {
+	config, _, mockCtrl := newHarness(t)
+	defer mockCtrl.Finish()
+
+	r := httptest.NewRequest(http.MethodGet, "/address/"+address+"/transactions", nil)
+	r.Header.Set("Accept", "text/html, "+codec.ContentTypeMsgpack)
+	r.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	w := serveHTTP(worker.NewHTTPHandler(config.Account), r)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != codec.ContentTypeMsgpack ||
+		w.Header().Get("Content-Encoding") != codec.EncodingGzip || w.Header().Get("Vary") != "Accept, Accept-Encoding" {
+		t.Fatalf("Unexpected response %d %v", w.Code, w.Header())
+	}
+	res, err := codec.Decompress(w.Body.Bytes(), codec.EncodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Command string   `json:"command"`
+		Data    []string `json:"data"`
+	}
+	if err := codec.ForContentType(codec.ContentTypeMsgpack).Unmarshal(res, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Command != "transactions" || len(result.Data) != 1 || result.Data[0] != "5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+}
+
+func TestHTTPRoutes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	handler := worker.NewHTTPHandler(&account.Config{
+		Btcd:  mockBtcd.NewMockBtcd(mockCtrl),
+		Mongo: mockMongo.NewMockMongo(mockCtrl),
+		Redis: mockRedis.NewMockRedis(mockCtrl),
+	})
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodPost, "/address/" + address + "/balance", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/address/" + address, http.StatusNotFound},
+		{http.MethodGet, "/address/", http.StatusNotFound},
+		{http.MethodGet, "/address/" + address + "/balance/extra", http.StatusNotFound},
+		{http.MethodGet, "/accounts/" + address + "/balance", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w := serveHTTP(handler, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.status {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.status, w.Code)
+		}
+		if c.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != http.MethodGet {
+			t.Errorf("%s %s: expected header Allow, got %v", c.method, c.path, w.Header())
+		}
+	}
+}
+
+func TestHTTPErrorStatus(t *testing.T) {
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	cacheKey := utils.GenCacheKey(address, rs.CommandAll)
+	cases := []struct {
+		name      string
+		path      string
+		cancelled bool
+		mock      func(node *mockBtcd.MockBtcd, mongo *mockMongo.MockMongo, redis *mockRedis.MockRedis)
+		status    int
+		code      string
+		retryable bool
+	}{
+		{
+			name:   "malformed parameter",
+			path:   "/balance?minConfirmations=many",
+			status: http.StatusBadRequest,
+			code:   worker.ErrorCodeInvalidRequest,
+		},
+		{
+			name:   "invalid parameter",
+			path:   "/balanceAt",
+			status: http.StatusBadRequest,
+			code:   worker.ErrorCodeInvalidRequest,
+		},
+		{
+			name:   "unsupported task",
+			path:   "/ledger",
+			status: http.StatusNotFound,
+			code:   worker.ErrorCodeUnsupportedTask,
+		},
+		{
+			name:      "cancelled",
+			path:      "/balance",
+			cancelled: true,
+			status:    http.StatusGatewayTimeout,
+			code:      worker.ErrorCodeDeadlineExceeded,
+		},
+		{
+			name: "state key not found",
+			path: "/balance",
+			mock: func(node *mockBtcd.MockBtcd, mongo *mockMongo.MockMongo, redis *mockRedis.MockRedis) {
+				redis.EXPECT().Get(stateKey).Return("", goredis.Nil)
+			},
+			status: http.StatusInternalServerError,
+			code:   worker.ErrorCodeStateKeyNotFound,
+		},
+		{
+			name: "corrupted data",
+			path: "/balance",
+			mock: func(node *mockBtcd.MockBtcd, mongo *mockMongo.MockMongo, redis *mockRedis.MockRedis) {
+				redis.EXPECT().Get(stateKey).Return("9", nil)
+			},
+			status: http.StatusInternalServerError,
+			code:   worker.ErrorCodeCorruptedData,
+		},
+		{
+			name: "redis",
+			path: "/balance",
+			mock: func(node *mockBtcd.MockBtcd, mongo *mockMongo.MockMongo, redis *mockRedis.MockRedis) {
+				redis.EXPECT().Get(stateKey).Return("", errors.New("connection refused"))
+			},
+			status:    http.StatusServiceUnavailable,
+			code:      worker.ErrorCodeRedis,
+			retryable: true,
+		},
+		{
+			name: "mongo",
+			path: "/balance",
+			mock: func(node *mockBtcd.MockBtcd, mongo *mockMongo.MockMongo, redis *mockRedis.MockRedis) {
+				redis.EXPECT().Get(stateKey).Return(rs.StateAlreadyExisting, nil)
+				redis.EXPECT().Get(cacheKey).Return("", goredis.Nil)
+				mongo.EXPECT().GetUserHistory(address).Return(nil, errors.New("no reachable servers"))
+			},
+			status:    http.StatusServiceUnavailable,
+			code:      worker.ErrorCodeMongo,
+			retryable: true,
+		},
+		{
+			name: "btcd",
+			path: "/balance",
+			mock: func(node *mockBtcd.MockBtcd, mongo *mockMongo.MockMongo, redis *mockRedis.MockRedis) {
+				redis.EXPECT().Get(stateKey).Return(rs.StateNew, nil)
+				node.EXPECT().GetInfo().Return(nil, errors.New("connection refused"))
+			},
+			status:    http.StatusServiceUnavailable,
+			code:      worker.ErrorCodeBtcdUnavailable,
+			retryable: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			node := mockBtcd.NewMockBtcd(mockCtrl)
+			mongo := mockMongo.NewMockMongo(mockCtrl)
+			redis := mockRedis.NewMockRedis(mockCtrl)
+			redis.EXPECT().Del(stateKey).Return(nil).AnyTimes()
+			if c.mock != nil {
+				c.mock(node, mongo, redis)
+			}
+			handler := worker.NewHTTPHandler(&account.Config{Btcd: node, Mongo: mongo, Redis: redis})
+
+			r := httptest.NewRequest(http.MethodGet, "/address/"+address+c.path, nil)
+			if c.cancelled {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				r = r.WithContext(ctx)
+			}
+			w := serveHTTP(handler, r)
+
+			var res httpError
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != c.status || res.Status != worker.StatusError || res.Error.Code != c.code || res.Error.Retryable != c.retryable {
+				t.Errorf("Expected %d %s, got %d %s", c.status, c.code, w.Code, w.Body.String())
+			}
+		})
+	}
+}
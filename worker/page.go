@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+// page selects a window of the list returned by commands 'transactions', 'unspents' and 'history'
+// Limit 0 selects everything from Offset onwards
+type page struct {
+	Offset int
+	Limit  int
+}
+
+// newPage resolves the page of the request. The cursor carries offset and limit of the next page
+// while limit given along with the cursor takes precedence
+func newPage(offset int, limit int, cursor string) (page, error) {
+	p := page{offset, limit}
+	if cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return page{}, err
+		}
+		p.Offset = c.Offset
+		if limit == 0 {
+			p.Limit = c.Limit
+		}
+	}
+
+	if p.Offset < 0 {
+		return page{}, ValidationError{Field: "offset", Reason: "must not be negative"}
+	}
+	if p.Limit < 0 {
+		return page{}, ValidationError{Field: "limit", Reason: "must not be negative"}
+	}
+	return p, nil
+}
+
+// bounds returns the window of the page in the list of the length, and cursor of the next page if any
+func (p page) bounds(total int) (int, int, string) {
+	start := p.Offset
+	if start > total {
+		start = total
+	}
+	end := total
+	if p.Limit != 0 && start+p.Limit < total {
+		end = start + p.Limit
+	}
+
+	next := ""
+	if end < total {
+		next = encodeCursor(page{end, p.Limit})
+	}
+	return start, end, next
+}
+
+// encodeCursor hides the page behind an opaque token
+func encodeCursor(p page) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(p.Offset) + ":" + strconv.Itoa(p.Limit)))
+}
+
+func decodeCursor(cursor string) (page, error) {
+	invalidErr := ValidationError{Field: "cursor", Reason: "malformed"}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return page{}, invalidErr
+	}
+
+	fields := strings.Split(string(raw), ":")
+	if len(fields) != 2 {
+		return page{}, invalidErr
+	}
+	offset, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return page{}, invalidErr
+	}
+	limit, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return page{}, invalidErr
+	}
+	return page{offset, limit}, nil
+}
@@ -0,0 +1,42 @@
+package worker
+
+import "testing"
+
+func TestPageCursor(t *testing.T) {
+	p, err := newPage(0, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var windows [][2]int
+	for {
+		start, end, next := p.bounds(5)
+		windows = append(windows, [2]int{start, end})
+		if next == "" {
+			break
+		}
+		p, err = newPage(0, 0, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := [][2]int{{0, 2}, {2, 4}, {4, 5}}
+	if len(windows) != len(expected) {
+		t.Fatalf("Expected pages %v, got %v", expected, windows)
+	}
+	for i, w := range windows {
+		if w != expected[i] {
+			t.Errorf("Expected pages %v, got %v", expected, windows)
+		}
+	}
+}
+
+func TestPageInvalid(t *testing.T) {
+	if _, err := newPage(-1, 0, ""); err == nil {
+		t.Error("Expected negative offset rejected")
+	}
+	if _, err := newPage(0, 0, "not a cursor"); err == nil {
+		t.Error("Expected malformed cursor rejected")
+	}
+}
@@ -0,0 +1,59 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/junzhli/btcd-address-indexing-worker/account"
+	"github.com/junzhli/btcd-address-indexing-worker/logger"
+)
+
+// QueryOptions shape the result of Query the same as fields of requests do
+type QueryOptions struct {
+	// Units of balances, which defaults to btc in float
+	Units string
+	// MinConfirmations counts only transactions confirmed at least the times toward the result
+	MinConfirmations int
+	// Height and Timestamp select the point of task 'balanceAt'
+	Height    *int
+	Timestamp *time.Time
+	// Interval, From and To shape task 'balanceSeries'
+	Interval string
+	From     *time.Time
+	To       *time.Time
+}
+
+// Query serves the task for the address once and returns the response as replied to the caller
+// The response is the error envelope along with the error if the task fails
+func Query(ctx context.Context, lg *log.Logger, config *account.Config, task string, addr string, opts QueryOptions) (interface{}, error) {
+	base := responseBase{
+		Version: SchemaVersion,
+		Command: task,
+		Account: addr,
+		Status:  StatusOK,
+	}
+
+	req := request{
+		Account:          addr,
+		Task:             task,
+		Units:            opts.Units,
+		MinConfirmations: opts.MinConfirmations,
+		Height:           opts.Height,
+		Timestamp:        opts.Timestamp,
+		Interval:         opts.Interval,
+		From:             opts.From,
+		To:               opts.To,
+	}
+	taskOpts, err := validateRequest(req)
+	if err != nil {
+		return newResponseError(base, err), err
+	}
+
+	acout := account.New(lg, logger.New(lg), config)
+	result, err := runTask(ctx, acout, base, taskOpts)
+	if err != nil {
+		return newResponseError(base, err), err
+	}
+	return result, nil
+}
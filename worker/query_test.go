@@ -0,0 +1,96 @@
+package worker_test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/junzhli/btcd-address-indexing-worker/account"
+	mockBtcd "github.com/junzhli/btcd-address-indexing-worker/btcd/mocks"
+	mockMongo "github.com/junzhli/btcd-address-indexing-worker/mongo/mocks"
+	mockRedis "github.com/junzhli/btcd-address-indexing-worker/redis/mocks"
+	"github.com/junzhli/btcd-address-indexing-worker/worker"
+)
+
+func TestQuery(t *testing.T) {
+	height := -1
+	cases := []struct {
+		name     string
+		task     string
+		opts     worker.QueryOptions
+		served   bool
+		expected string
+	}{
+		{
+			name:   "balance",
+			task:   worker.CommandBalance,
+			opts:   worker.QueryOptions{Units: "satoshi"},
+			served: true,
+			expected: `{"version":1,"command":"balance","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","status":"ok",` +
+				`"data":160720958,"balanceBtc":"1.60720958","confirmed":160720958,"unconfirmed":0,"pending":{"incoming":[],"outgoing":[]}}`,
+		},
+		{
+			name:   "transactions",
+			task:   worker.CommandTransactions,
+			served: true,
+			expected: `{"version":1,"command":"transactions","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","status":"ok",` +
+				`"data":["5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d"],"total":1}`,
+		},
+		{
+			name: "unsupported task",
+			task: "ledger",
+			expected: `{"version":1,"command":"ledger","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","status":"error",` +
+				`"error":{"code":"unsupported_task","message":"Unsupported task: ledger","retryable":false}}`,
+		},
+		{
+			name: "invalid units",
+			task: worker.CommandBalance,
+			opts: worker.QueryOptions{Units: "mbtc"},
+			expected: `{"version":1,"command":"balance","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","status":"error",` +
+				`"error":{"code":"invalid_request","message":"Invalid field 'units': unsupported units mbtc","retryable":false,"field":"units"}}`,
+		},
+		{
+			name: "option of another task",
+			task: worker.CommandBalance,
+			opts: worker.QueryOptions{Height: &height},
+			expected: `{"version":1,"command":"balance","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","status":"error",` +
+				`"error":{"code":"invalid_request","message":"Invalid field 'task': height and timestamp apply to task balanceAt only","retryable":false,"field":"task"}}`,
+		},
+	}
+
+	lg := log.New(os.Stderr, "[Query] ", log.LstdFlags)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var config *account.Config
+			if c.served {
+				harness, _, mockCtrl := newHarness(t)
+				defer mockCtrl.Finish()
+				config = harness.Account
+			} else {
+				// nothing reaches backends
+				mockCtrl := gomock.NewController(t)
+				defer mockCtrl.Finish()
+				config = &account.Config{
+					Btcd:  mockBtcd.NewMockBtcd(mockCtrl),
+					Mongo: mockMongo.NewMockMongo(mockCtrl),
+					Redis: mockRedis.NewMockRedis(mockCtrl),
+				}
+			}
+
+			result, err := worker.Query(context.Background(), lg, config, c.task, address, c.opts)
+			if (err == nil) != c.served {
+				t.Errorf("Unexpected error %v", err)
+			}
+			res, err := json.Marshal(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(res) != c.expected {
+				t.Errorf("Unexpected result\nexpected: %s\ngot:      %s", c.expected, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package worker
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// messageTypes lists every message type by the name of its schema
+var messageTypes = map[string]interface{}{
+	"request":                     request{},
+	"response_balance":            responseBalance{},
+	"response_balance_satoshi":    responseBalanceSatoshi{},
+	"response_balance_at":         responseBalanceAt{},
+	"response_balance_at_satoshi": responseBalanceAtSatoshi{},
+	"response_balance_series":     responseBalanceSeries{},
+	"response_transactions":       responseTransactions{},
+	"response_unspents":           responseUnspents{},
+	"response_history":            responseHistory{},
+	"response_all":                responseAll{},
+	"response_all_satoshi":        responseAllSatoshi{},
+	"response_batch":              responseBatch{},
+	"response_error":              responseError{},
+}
+
+// Schemas returns JSON Schema definitions of every message type keyed by name, which are generated from the types
+// Definitions shipped under directory 'schema' are kept up to date by tests
+func Schemas() (map[string][]byte, error) {
+	schemas := make(map[string][]byte)
+	for name, v := range messageTypes {
+		schema := typeSchema(reflect.TypeOf(v))
+		schema["$schema"] = jsonSchemaDraft
+		schema["title"] = name
+		annotateSchema(name, schema)
+
+		res, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		schemas[name] = append(res, '\n')
+	}
+	return schemas, nil
+}
+
+// annotateSchema adds constraints which could not be told from the types
+func annotateSchema(name string, schema map[string]interface{}) {
+	properties := schema["properties"].(map[string]interface{})
+	property := func(name string) map[string]interface{} {
+		return properties[name].(map[string]interface{})
+	}
+
+	if name == "request" {
+		property("version")["minimum"] = 1
+		property("version")["maximum"] = SchemaVersion
+		property("task")["enum"] = commands
+		property("acceptEncoding")["enum"] = []string{"gzip"}
+		property("units")["enum"] = []string{UnitsBTC, UnitsSatoshi}
+		property("minConfirmations")["minimum"] = 0
+		property("height")["minimum"] = 0
+		property("interval")["enum"] = intervals
+		schema["oneOf"] = []interface{}{
+			map[string]interface{}{"required": []string{"account"}},
+			map[string]interface{}{"required": []string{"accounts"}},
+		}
+		return
+	}
+
+	property("version")["const"] = SchemaVersion
+	property("status")["enum"] = []string{StatusOK, StatusError}
+	if name == "response_error" {
+		// command echoes the request as it is, which might be unknown
+		code := property("error")["properties"].(map[string]interface{})["code"].(map[string]interface{})
+		code["enum"] = errorCodes
+		return
+	}
+	property("command")["enum"] = commands
+	if name == "response_balance_series" {
+		property("interval")["enum"] = intervals
+	}
+}
+
+// typeSchema describes the type in JSON Schema following the rules of encoding/json
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := make([]string, 0)
+		structFields(t, properties, &required)
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	}
+	// any value
+	return map[string]interface{}{}
+}
+
+// structFields collects exported fields of the struct into properties with embedded structs inlined
+// Fields without option 'omitempty' are required
+func structFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx != -1 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			structFields(f.Type, properties, required)
+			continue
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		properties[name] = typeSchema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
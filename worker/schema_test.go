@@ -0,0 +1,46 @@
+package worker_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/junzhli/btcd-address-indexing-worker/worker"
+)
+
+var update = flag.Bool("update", false, "update JSON Schema definitions under directory 'schema'")
+
+const schemaDir = "../schema"
+
+func TestSchemasUpToDate(t *testing.T) {
+	schemas, err := worker.Schemas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		if err := os.MkdirAll(schemaDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, schema := range schemas {
+		path := filepath.Join(schemaDir, name+".json")
+		if *update {
+			if err := ioutil.WriteFile(path, schema, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		shipped, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("Missing schema %s: %s (run go test ./worker -update)", name, err)
+			continue
+		}
+		if string(shipped) != string(schema) {
+			t.Errorf("Schema %s is out of date (run go test ./worker -update)", name)
+		}
+	}
+}
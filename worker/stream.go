@@ -0,0 +1,167 @@
+package worker
+
+import (
+	"fmt"
+
+	"github.com/junzhli/btcd-address-indexing-worker/mongo"
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+)
+
+// chunkFunc shapes the chunk of the sequence number
+type chunkFunc func(sequence int, final bool) interface{}
+
+// streamResult publishes the result as a sequence of chunks holding at most size items each
+// Every chunk shares the shape of the response of the command, the correlation id and carries fields 'sequence' and 'final'
+// Lists of the result are split across chunks, which the caller concatenates in the order of sequence
+// The result which could not be streamed is replied with error internal_error instead
+func streamResult(tr transport.Transport, d transport.Delivery, enc replyEncoding, base responseBase, result interface{}, size int) error {
+	chunks, splitErr := splitResult(result, size)
+	if splitErr != nil {
+		chunks, _ = splitResult(newResponseError(base, splitErr), 0)
+	}
+	for i, chunk := range chunks {
+		err := reply(tr, d, enc, base.RequestID, chunk(i, i == len(chunks)-1))
+		if err != nil {
+			return err
+		}
+	}
+	return splitErr
+}
+
+// splitResult cuts lists of the result into chunks. Results without lists are left in one chunk
+func splitResult(result interface{}, size int) ([]chunkFunc, error) {
+	var chunks []chunkFunc
+	switch r := result.(type) {
+	case responseTransactions:
+		forEachChunk(len(r.DataTx), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				return responseTransactions{chunkBase(r.responseBase, sequence, final), r.DataTx[start:end], r.Total, r.NextCursor}
+			})
+		})
+	case responseUnspents:
+		forEachChunk(len(r.DataUspt), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				return responseUnspents{chunkBase(r.responseBase, sequence, final), r.DataUspt[start:end], r.Total, r.NextCursor}
+			})
+		})
+	case responseHistory:
+		forEachChunk(len(r.DataHistory), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				return responseHistory{chunkBase(r.responseBase, sequence, final), r.DataHistory[start:end], r.Total, r.NextCursor}
+			})
+		})
+	case responseAll:
+		// transactions go first and then unspents
+		data := r.DataAll
+		forEachChunk(len(data.Transactions), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				chunk := data
+				chunk.Transactions = data.Transactions[start:end]
+				chunk.Unspents = []mongo.Unspent{}
+				return responseAll{chunkBase(r.responseBase, sequence, final), chunk}
+			})
+		})
+		forEachChunk(len(data.Unspents), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				chunk := data
+				chunk.Transactions = []string{}
+				chunk.Unspents = data.Unspents[start:end]
+				return responseAll{chunkBase(r.responseBase, sequence, final), chunk}
+			})
+		})
+	case responseAllSatoshi:
+		data := r.DataAll
+		forEachChunk(len(data.Transactions), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				chunk := data
+				chunk.Transactions = data.Transactions[start:end]
+				chunk.Unspents = []mongo.Unspent{}
+				return responseAllSatoshi{chunkBase(r.responseBase, sequence, final), chunk}
+			})
+		})
+		forEachChunk(len(data.Unspents), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				chunk := data
+				chunk.Transactions = []string{}
+				chunk.Unspents = data.Unspents[start:end]
+				return responseAllSatoshi{chunkBase(r.responseBase, sequence, final), chunk}
+			})
+		})
+	case responseBalanceSeries:
+		forEachChunk(len(r.DataSeries), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				return responseBalanceSeries{chunkBase(r.responseBase, sequence, final), r.DataSeries[start:end], r.Interval}
+			})
+		})
+	case responseBalanceAt:
+		forEachChunk(len(r.Unspents), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				chunk := r
+				chunk.responseBase = chunkBase(r.responseBase, sequence, final)
+				chunk.Unspents = r.Unspents[start:end]
+				return chunk
+			})
+		})
+	case responseBalanceAtSatoshi:
+		forEachChunk(len(r.Unspents), size, func(start, end int) {
+			chunks = append(chunks, func(sequence int, final bool) interface{} {
+				chunk := r
+				chunk.responseBase = chunkBase(r.responseBase, sequence, final)
+				chunk.Unspents = r.Unspents[start:end]
+				return chunk
+			})
+		})
+	case responseBalanceSatoshi:
+		chunks = append(chunks, func(sequence int, final bool) interface{} {
+			chunk := r
+			chunk.responseBase = chunkBase(r.responseBase, sequence, final)
+			return chunk
+		})
+	case responseBalance:
+		chunks = append(chunks, func(sequence int, final bool) interface{} {
+			chunk := r
+			chunk.responseBase = chunkBase(r.responseBase, sequence, final)
+			return chunk
+		})
+	case responseBatch:
+		chunks = append(chunks, func(sequence int, final bool) interface{} {
+			return responseBatch{chunkBase(r.responseBase, sequence, final), r.DataBatch}
+		})
+	case responseError:
+		chunks = append(chunks, func(sequence int, final bool) interface{} {
+			return responseError{chunkBase(r.responseBase, sequence, final), r.Error}
+		})
+	}
+
+	if len(chunks) == 0 {
+		if size == 0 {
+			// every result served by the worker is cut into one chunk at least without size
+			return nil, UnsupportedResultError{Type: fmt.Sprintf("%T", result)}
+		}
+		// an empty list still ends the stream with a chunk
+		return splitResult(result, 0)
+	}
+	return chunks, nil
+}
+
+// forEachChunk calls fn with bounds of every chunk of the list of the length
+// Size 0 takes the whole list as one chunk
+func forEachChunk(length int, size int, fn func(start, end int)) {
+	if size == 0 {
+		fn(0, length)
+		return
+	}
+	for start := 0; start < length; start += size {
+		end := start + size
+		if end > length {
+			end = length
+		}
+		fn(start, end)
+	}
+}
+
+func chunkBase(base responseBase, sequence int, final bool) responseBase {
+	base.Sequence = &sequence
+	base.Final = &final
+	return base
+}
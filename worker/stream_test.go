@@ -0,0 +1,47 @@
+package worker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/junzhli/btcd-address-indexing-worker/codec"
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+	"github.com/junzhli/btcd-address-indexing-worker/transport/memory"
+)
+
+func TestSplitResultEmpty(t *testing.T) {
+	chunks, err := splitResult(responseTransactions{DataTx: []string{}}, 10)
+	if err != nil || len(chunks) != 1 {
+		t.Fatalf("expected one chunk, got %d %v", len(chunks), err)
+	}
+	chunk := chunks[0](0, true).(responseTransactions)
+	if *chunk.Sequence != 0 || !*chunk.Final || len(chunk.DataTx) != 0 {
+		t.Errorf("unexpected chunk %+v", chunk)
+	}
+}
+
+func TestSplitResultUnsupported(t *testing.T) {
+	chunks, err := splitResult(page{}, 10)
+	if unsupported, ok := err.(UnsupportedResultError); !ok || unsupported.Type != "worker.page" || chunks != nil {
+		t.Fatalf("expected error naming the type, got %v %v", chunks, err)
+	}
+
+	// the error is replied instead
+	tr := memory.New(1)
+	base := responseBase{Version: SchemaVersion, Command: CommandAll, Account: "15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR", RequestID: "req-1"}
+	enc := replyEncoding{codec: codec.ForContentType(codec.ContentTypeJSON)}
+	if _, ok := streamResult(tr, transport.Delivery{}, enc, base, page{}, 10).(UnsupportedResultError); !ok {
+		t.Fatal("expected the error returned")
+	}
+	messages := tr.Messages()
+	if len(messages) != 1 || messages[0].Reply.CorrelationID != "req-1" {
+		t.Fatalf("expected one reply, got %+v", messages)
+	}
+	var res responseError
+	if err := json.Unmarshal(messages[0].Reply.Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != StatusError || res.Error.Code != ErrorCodeInternal || !*res.Final {
+		t.Errorf("unexpected reply %s", messages[0].Reply.Body)
+	}
+}
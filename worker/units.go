@@ -0,0 +1,30 @@
+package worker
+
+import (
+	"strconv"
+	"strings"
+)
+
+// units of balances
+const (
+	UnitsBTC     = "btc"
+	UnitsSatoshi = "satoshi"
+)
+
+const satoshi = 100000000
+
+// formatBTC formats the amount in satoshis as the decimal string in btc without loss of precision
+func formatBTC(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	fraction := strconv.FormatInt(amount%satoshi, 10)
+	return sign + strconv.FormatInt(amount/satoshi, 10) + "." + strings.Repeat("0", 8-len(fraction)) + fraction
+}
+
+// toBTC converts the amount in satoshis to btc in float for legacy clients
+func toBTC(amount int64) float64 {
+	return float64(amount) / satoshi
+}
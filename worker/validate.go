@@ -0,0 +1,156 @@
+package worker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/junzhli/btcd-address-indexing-worker/account"
+	"github.com/junzhli/btcd-address-indexing-worker/codec"
+)
+
+// SchemaVersion is the version of the message schema served by the worker
+// Requests of later versions are rejected, while those without version are taken as version 1
+const SchemaVersion = 1
+
+// genesisTime is the block time of the genesis block, before which balances are never requested
+var genesisTime = time.Unix(1231006505, 0)
+
+var intervals = []string{account.IntervalTransaction, account.IntervalDay, account.IntervalMonth}
+
+// taskOptions carries options of the request shaping the result of the task
+type taskOptions struct {
+	page             page
+	units            string
+	minConfirmations uint64
+	point            account.Point
+	series           seriesOptions
+}
+
+// seriesOptions shapes the balance series, where zero from and to are left open
+type seriesOptions struct {
+	interval string
+	from     time.Time
+	to       time.Time
+}
+
+// validateBatchSize checks the number of accounts of the batch task against the max, which is unlimited if not positive
+func validateBatchSize(req request, max int) error {
+	if max > 0 && len(req.Accounts) > max {
+		return ValidationError{Field: "accounts", Reason: "must hold no more than " + strconv.Itoa(max) + " addresses"}
+	}
+	return nil
+}
+
+// validateRequest checks the request against the schema and resolves options of the task
+func validateRequest(req request) (taskOptions, error) {
+	if req.Version < 0 || req.Version > SchemaVersion {
+		return taskOptions{}, ValidationError{Field: "version", Reason: "unsupported version " + strconv.Itoa(req.Version) + ", up to " + strconv.Itoa(SchemaVersion)}
+	}
+
+	if req.Task == "" {
+		return taskOptions{}, ValidationError{Field: "task", Reason: "is required"}
+	}
+	if !isSupportedTask(req.Task) {
+		return taskOptions{}, UnsupportedTaskError{Task: req.Task}
+	}
+
+	switch {
+	case req.Account == "" && len(req.Accounts) == 0:
+		return taskOptions{}, ValidationError{Field: "account", Reason: "is required"}
+	case req.Account != "" && len(req.Accounts) != 0:
+		return taskOptions{}, ValidationError{Field: "accounts", Reason: "must not be given along with account"}
+	}
+	for i, addr := range req.Accounts {
+		if addr == "" {
+			return taskOptions{}, ValidationError{Field: "accounts[" + strconv.Itoa(i) + "]", Reason: "is required"}
+		}
+	}
+
+	paginated := req.Offset != 0 || req.Limit != 0 || req.Cursor != ""
+	if paginated && req.Task != CommandTransactions && req.Task != CommandUnspents && req.Task != CommandHistory {
+		return taskOptions{}, ValidationError{Field: "task", Reason: "pagination applies to tasks transactions, unspents and history only"}
+	}
+	if req.Cursor != "" && req.Offset != 0 {
+		return taskOptions{}, ValidationError{Field: "offset", Reason: "must not be given along with cursor"}
+	}
+
+	if req.ChunkSize < 0 {
+		return taskOptions{}, ValidationError{Field: "chunkSize", Reason: "must not be negative"}
+	}
+	if req.ChunkSize != 0 && !req.Stream {
+		return taskOptions{}, ValidationError{Field: "chunkSize", Reason: "applies to streamed results only"}
+	}
+
+	switch req.AcceptEncoding {
+	case "", codec.EncodingGzip:
+	default:
+		return taskOptions{}, ValidationError{Field: "acceptEncoding", Reason: "unsupported content encoding " + req.AcceptEncoding}
+	}
+
+	switch req.Units {
+	case "", UnitsBTC, UnitsSatoshi:
+	default:
+		return taskOptions{}, ValidationError{Field: "units", Reason: "unsupported units " + req.Units}
+	}
+
+	if req.MinConfirmations < 0 {
+		return taskOptions{}, ValidationError{Field: "minConfirmations", Reason: "must not be negative"}
+	}
+
+	var point account.Point
+	if req.Task == CommandBalanceAt {
+		switch {
+		case req.Height == nil && req.Timestamp == nil:
+			return taskOptions{}, ValidationError{Field: "height", Reason: "either height or timestamp is required"}
+		case req.Height != nil && req.Timestamp != nil:
+			return taskOptions{}, ValidationError{Field: "timestamp", Reason: "must not be given along with height"}
+		case req.Height != nil && *req.Height < 0:
+			return taskOptions{}, ValidationError{Field: "height", Reason: "must not be negative"}
+		case req.Height != nil:
+			point.Height = uint64(*req.Height)
+		case req.Timestamp.Before(genesisTime):
+			return taskOptions{}, ValidationError{Field: "timestamp", Reason: "must not be before the genesis block"}
+		default:
+			point.Time = *req.Timestamp
+		}
+	} else if req.Height != nil || req.Timestamp != nil {
+		return taskOptions{}, ValidationError{Field: "task", Reason: "height and timestamp apply to task balanceAt only"}
+	}
+
+	var series seriesOptions
+	if req.Task == CommandBalanceSeries {
+		series.interval = req.Interval
+		if !isSupportedInterval(req.Interval) {
+			return taskOptions{}, ValidationError{Field: "interval", Reason: "unsupported interval " + req.Interval}
+		}
+		if req.From != nil {
+			if req.From.Before(genesisTime) {
+				return taskOptions{}, ValidationError{Field: "from", Reason: "must not be before the genesis block"}
+			}
+			series.from = *req.From
+		}
+		if req.To != nil {
+			if req.From != nil && req.To.Before(*req.From) {
+				return taskOptions{}, ValidationError{Field: "to", Reason: "must not be before from"}
+			}
+			series.to = *req.To
+		}
+	} else if req.Interval != "" || req.From != nil || req.To != nil {
+		return taskOptions{}, ValidationError{Field: "task", Reason: "interval, from and to apply to task balanceSeries only"}
+	}
+
+	p, err := newPage(req.Offset, req.Limit, req.Cursor)
+	if err != nil {
+		return taskOptions{}, err
+	}
+	return taskOptions{p, req.Units, uint64(req.MinConfirmations), point, series}, nil
+}
+
+func isSupportedInterval(interval string) bool {
+	for _, val := range intervals {
+		if interval == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,537 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/junzhli/btcd-address-indexing-worker/account"
+	"github.com/junzhli/btcd-address-indexing-worker/codec"
+	"github.com/junzhli/btcd-address-indexing-worker/logger"
+	"github.com/junzhli/btcd-address-indexing-worker/mongo"
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+)
+
+// Config includes all necessary arguments for serving tasks
+type Config struct {
+	Account          *account.Config
+	MaxRetries       int
+	BatchConcurrency int
+	// ChunkSize is the number of items per chunk of streamed results unless given by the request
+	ChunkSize int
+	// MaxBatchSize is the max number of accounts of a batch task, which is unlimited if not positive
+	MaxBatchSize int
+}
+
+type request struct {
+	// Version is the schema version the request conforms to, which defaults to 1
+	Version   int        `json:"version,omitempty"`
+	Account   string     `json:"account,omitempty"`
+	Accounts  []string   `json:"accounts,omitempty"`
+	Task      string     `json:"task"`
+	RequestID string     `json:"requestId,omitempty"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+	Offset    int        `json:"offset,omitempty"`
+	Limit     int        `json:"limit,omitempty"`
+	Cursor    string     `json:"cursor,omitempty"`
+	Stream    bool       `json:"stream,omitempty"`
+	ChunkSize int        `json:"chunkSize,omitempty"`
+	// AcceptEncoding asks for replies compressed with the content encoding
+	AcceptEncoding string `json:"acceptEncoding,omitempty"`
+	// Units of balances, which defaults to btc in float
+	Units string `json:"units,omitempty"`
+	// MinConfirmations counts only transactions confirmed at least the times toward the result, which defaults to 1
+	MinConfirmations int `json:"minConfirmations,omitempty"`
+	// Height and Timestamp select the point of task 'balanceAt', exactly one of which is given
+	Height    *int       `json:"height,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// Interval, From and To shape task 'balanceSeries', where From and To are optional
+	Interval string     `json:"interval,omitempty"`
+	From     *time.Time `json:"from,omitempty"`
+	To       *time.Time `json:"to,omitempty"`
+}
+
+type responseBase struct {
+	Version   int    `json:"version"`
+	Command   string `json:"command"`
+	Account   string `json:"account"`
+	RequestID string `json:"requestId,omitempty"`
+	Status    string `json:"status"`
+	// set on chunks of streamed results only
+	Sequence *int  `json:"sequence,omitempty"`
+	Final    *bool `json:"final,omitempty"`
+}
+
+// responseBalance carries the confirmed balance as data
+type responseBalance struct {
+	responseBase
+	DataBalance float64         `json:"data"`
+	Confirmed   float64         `json:"confirmed"`
+	Unconfirmed float64         `json:"unconfirmed"`
+	Pending     account.Pending `json:"pending"`
+}
+
+type responseBalanceSatoshi struct {
+	responseBase
+	DataBalance int64           `json:"data"`
+	BalanceBTC  string          `json:"balanceBtc"`
+	Confirmed   int64           `json:"confirmed"`
+	Unconfirmed int64           `json:"unconfirmed"`
+	Pending     account.Pending `json:"pending"`
+}
+
+// responseBalanceAt carries the confirmed balance as of the point as data, which echoes the point requested
+type responseBalanceAt struct {
+	responseBase
+	DataBalance float64         `json:"data"`
+	Height      *uint64         `json:"height,omitempty"`
+	Timestamp   *time.Time      `json:"timestamp,omitempty"`
+	Unspents    []mongo.Unspent `json:"unspents"`
+}
+
+type responseBalanceAtSatoshi struct {
+	responseBase
+	DataBalance int64           `json:"data"`
+	BalanceBTC  string          `json:"balanceBtc"`
+	Height      *uint64         `json:"height,omitempty"`
+	Timestamp   *time.Time      `json:"timestamp,omitempty"`
+	Unspents    []mongo.Unspent `json:"unspents"`
+}
+
+// responseBalanceSeries carries balances in satoshis over time as data
+type responseBalanceSeries struct {
+	responseBase
+	DataSeries []account.BalancePoint `json:"data"`
+	Interval   string                 `json:"interval"`
+}
+
+type responseTransactions struct {
+	responseBase
+	DataTx     []string `json:"data"`
+	Total      int      `json:"total"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+type responseUnspents struct {
+	responseBase
+	DataUspt   []mongo.Unspent `json:"data"`
+	Total      int             `json:"total"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+type responseHistory struct {
+	responseBase
+	DataHistory []account.HistoryEntry `json:"data"`
+	Total       int                    `json:"total"`
+	NextCursor  string                 `json:"nextCursor,omitempty"`
+}
+
+type responseAll struct {
+	responseBase
+	DataAll account.UserData `json:"data"`
+}
+
+// userDataSatoshi is account.UserData with the balance in satoshis
+type userDataSatoshi struct {
+	Balance      int64           `json:"balance"`
+	BalanceBTC   string          `json:"balanceBtc"`
+	Transactions []string        `json:"transactions"`
+	Unspents     []mongo.Unspent `json:"unspents"`
+	Confirmed    int64           `json:"confirmed"`
+	Unconfirmed  int64           `json:"unconfirmed"`
+	Pending      account.Pending `json:"pending"`
+}
+
+type responseAllSatoshi struct {
+	responseBase
+	DataAll userDataSatoshi `json:"data"`
+}
+
+type responseBatch struct {
+	responseBase
+	DataBatch []interface{} `json:"data"`
+}
+
+type errorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+	// Field is the field of the request failing validation
+	Field string `json:"field,omitempty"`
+}
+
+type responseError struct {
+	responseBase
+	Error errorDetail `json:"error"`
+}
+
+// commands
+const (
+	CommandBalance       = "balance"
+	CommandTransactions  = "transactions"
+	CommandUnspents      = "unspents"
+	CommandAll           = "all"
+	CommandHistory       = "history"
+	CommandBalanceAt     = "balanceAt"
+	CommandBalanceSeries = "balanceSeries"
+)
+
+// commands lists all commands supported
+var commands = []string{CommandBalance, CommandTransactions, CommandUnspents, CommandAll, CommandHistory, CommandBalanceAt, CommandBalanceSeries}
+
+// response status
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// task outcomes
+const (
+	outcomeDone = iota
+	outcomeRetry
+	outcomeReject
+	outcomeRequeue
+)
+
+// DoTask serves the task carried by the delivery, replies the result to the caller and settles the delivery
+func DoTask(id int, d transport.Delivery, config *Config, tr transport.Transport) {
+	DoTaskContext(context.Background(), id, d, config, tr)
+}
+
+// DoTaskContext is DoTask bound to ctx
+// Once ctx is cancelled, the task in flight is aborted and its delivery goes back to the queue without reply
+func DoTaskContext(parent context.Context, id int, d transport.Delivery, config *Config, tr transport.Transport) {
+	lg := log.New(os.Stdout, "[Task "+strconv.Itoa(id)+"] ", log.LstdFlags)
+	lg2 := logger.New(lg)
+	accountConf := config.Account
+	if d.RetryCount > 0 && !accountConf.SkipStateKey {
+		// the state key set by the service is removed by the failed attempt,
+		// so redeliveries take the address as existing which looks up redis/database first
+		retryConf := *accountConf
+		retryConf.SkipStateKey = true
+		accountConf = &retryConf
+	}
+	acout := account.New(lg, lg2, accountConf)
+	lg.Printf("Received a message: %s", d.Body)
+
+	base := responseBase{
+		Version:   SchemaVersion,
+		RequestID: d.CorrelationID,
+		Status:    StatusOK,
+	}
+	// replies are encoded in the content type of the request
+	enc := replyEncoding{codec: codec.ForContentType(d.ContentType)}
+	// the delivery is settled only after the task finishes so that nothing is lost on crash
+	outcome := outcomeDone
+	defer func() {
+		settleDelivery(lg2, tr, d, outcome)
+	}()
+	// a panic is confined to the task itself instead of bringing the whole worker down
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("Panic occurred during the task: %v", r)
+			lg.Printf("%s\n%s", err, debug.Stack())
+			rejectTask(lg2, tr, d, enc, base, err)
+			outcome = outcomeReject
+		}
+	}()
+
+	var req request
+	body, err := codec.Decompress(d.Body, d.ContentEncoding)
+	if err == nil {
+		err = enc.codec.Unmarshal(body, &req)
+	}
+	if err != nil {
+		lg2.LogOnError(err, "Failed to parse request message from receiverChannel")
+		rejectTask(lg2, tr, d, enc, base, InvalidRequestError{Reason: err.Error()})
+		outcome = outcomeReject
+		return
+	}
+
+	base.Command = req.Task
+	base.Account = req.Account
+	// correlation id set by the caller takes precedence over the one carried in message body
+	if base.RequestID == "" {
+		base.RequestID = req.RequestID
+	}
+	opts, err := validateRequest(req)
+	if err == nil {
+		err = validateBatchSize(req, config.MaxBatchSize)
+	}
+	if err != nil {
+		lg2.LogOnError(err, "Rejects the task")
+		rejectTask(lg2, tr, d, enc, base, err)
+		outcome = outcomeReject
+		return
+	}
+	enc.contentEncoding = req.AcceptEncoding
+
+	ctx := parent
+	if deadline, ok := requestDeadline(d, req); ok {
+		if time.Now().After(deadline) {
+			err = DeadlineExceededError{Deadline: deadline}
+			lg2.LogOnError(err, "Skips the expired task")
+			rejectTask(lg2, tr, d, enc, base, err)
+			return
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	startTime := time.Now()
+	var result interface{}
+	if len(req.Accounts) != 0 {
+		lg.Printf("Batch task is requested with parameters: addrs => %d task => %s requestId => %s", len(req.Accounts), req.Task, base.RequestID)
+		result = runBatchTask(ctx, lg, acout, base, opts, req.Accounts, config.BatchConcurrency)
+	} else {
+		lg.Printf("Task is requested with parameters: addr => " + req.Account + " task => " + req.Task + " requestId => " + base.RequestID)
+		result, err = runTask(ctx, acout, base, opts)
+	}
+
+	if parent.Err() != nil {
+		lg.Printf("Aborts the task on shutdown... requeue it")
+		outcome = outcomeRequeue
+		return
+	}
+	if err != nil {
+		lg2.LogOnError(err, "Fails on the task")
+		if _, retryable := classifyError(err); retryable {
+			if d.RetryCount < config.MaxRetries {
+				outcome = outcomeRetry
+				return
+			}
+			lg.Printf("Gives up the task after %d retries", config.MaxRetries)
+			outcome = outcomeReject
+		}
+		result = newResponseError(base, err)
+	}
+
+	if req.Stream {
+		chunkSize := req.ChunkSize
+		if chunkSize == 0 {
+			chunkSize = config.ChunkSize
+		}
+		err = streamResult(tr, d, enc, base, result, chunkSize)
+		lg2.LogOnError(err, "Failed to stream the result for the task")
+	} else {
+		err = reply(tr, d, enc, base.RequestID, result)
+		lg2.LogOnError(err, "Failed to publish the result for the task")
+	}
+	elapsedTime := time.Since(startTime)
+	lg.Println("The requested task takes " + elapsedTime.String())
+}
+
+// requestDeadline returns the earliest deadline of the request given by either field 'deadline' of the message
+// or properties 'timestamp' plus 'expiration' of the delivery
+func requestDeadline(d transport.Delivery, req request) (time.Time, bool) {
+	var deadline time.Time
+	if req.Deadline != nil {
+		deadline = *req.Deadline
+	}
+
+	if d.Expiration != 0 && !d.Timestamp.IsZero() {
+		expiry := d.Timestamp.Add(d.Expiration)
+		if deadline.IsZero() || expiry.Before(deadline) {
+			deadline = expiry
+		}
+	}
+
+	return deadline, !deadline.IsZero()
+}
+
+// isSupportedTask tells whether the task is known to the worker
+func isSupportedTask(task string) bool {
+	for _, command := range commands {
+		if task == command {
+			return true
+		}
+	}
+	return false
+}
+
+// runTask serves the task for the address and shapes the result into the response of the command
+// List results of commands 'transactions' and 'unspents' are cut into the page
+func runTask(ctx context.Context, acout account.Account, base responseBase, opts taskOptions) (interface{}, error) {
+	p := opts.page
+	switch base.Command {
+	case CommandBalance:
+		detail, err := acout.GetAddressBalanceDetail(ctx, base.Account, opts.minConfirmations)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.units == UnitsSatoshi {
+			return responseBalanceSatoshi{base, detail.Confirmed, formatBTC(detail.Confirmed), detail.Confirmed, detail.Unconfirmed, detail.Pending}, nil
+		}
+		return responseBalance{base, toBTC(detail.Confirmed), toBTC(detail.Confirmed), toBTC(detail.Unconfirmed), detail.Pending}, nil
+	case CommandTransactions:
+		transactions, err := acout.GetAddressTransactions(ctx, base.Account, opts.minConfirmations)
+		if err != nil {
+			return nil, err
+		}
+		start, end, next := p.bounds(len(transactions))
+		return responseTransactions{base, transactions[start:end], len(transactions), next}, nil
+	case CommandUnspents:
+		unspents, err := acout.GetAddressUnspentOutputs(ctx, base.Account, opts.minConfirmations)
+		if err != nil {
+			return nil, err
+		}
+
+		start, end, next := p.bounds(len(unspents))
+		_unspents := make([]mongo.Unspent, 0)
+		for _, val := range unspents[start:end] {
+			_unspents = append(_unspents, *val)
+		}
+		return responseUnspents{base, _unspents, len(unspents), next}, nil
+	case CommandHistory:
+		history, err := acout.GetAddressHistory(ctx, base.Account, opts.minConfirmations)
+		if err != nil {
+			return nil, err
+		}
+		start, end, next := p.bounds(len(history))
+		return responseHistory{base, history[start:end], len(history), next}, nil
+	case CommandBalanceAt:
+		balance, err := acout.GetAddressBalanceAt(ctx, base.Account, opts.point)
+		if err != nil {
+			return nil, err
+		}
+
+		var height *uint64
+		var timestamp *time.Time
+		if opts.point.Time.IsZero() {
+			height = &opts.point.Height
+		} else {
+			timestamp = &opts.point.Time
+		}
+		if opts.units == UnitsSatoshi {
+			return responseBalanceAtSatoshi{base, balance.Balance, formatBTC(balance.Balance), height, timestamp, balance.Unspents}, nil
+		}
+		return responseBalanceAt{base, toBTC(balance.Balance), height, timestamp, balance.Unspents}, nil
+	case CommandBalanceSeries:
+		series, err := acout.GetAddressBalanceSeries(ctx, base.Account, opts.series.interval, opts.series.from, opts.series.to)
+		if err != nil {
+			return nil, err
+		}
+		return responseBalanceSeries{base, series, opts.series.interval}, nil
+	case CommandAll:
+		data, err := acout.GetAddressResult(ctx, base.Account, opts.minConfirmations)
+		if err != nil {
+			return nil, err
+		}
+		if opts.units == UnitsSatoshi {
+			detail := data.BalanceDetail()
+			return responseAllSatoshi{base, userDataSatoshi{
+				detail.Confirmed,
+				formatBTC(detail.Confirmed),
+				data.Transactions,
+				data.Unspents,
+				detail.Confirmed,
+				detail.Unconfirmed,
+				detail.Pending,
+			}}, nil
+		}
+		return responseAll{base, *data}, nil
+	}
+	return nil, UnsupportedTaskError{Task: base.Command}
+}
+
+// runBatchTask serves the task for every address with bounded parallelism
+// and aggregates the result or error of each address into one response
+func runBatchTask(ctx context.Context, lg *log.Logger, acout account.Account, base responseBase, opts taskOptions, accounts []string, parallelism int) responseBatch {
+	results := make([]interface{}, len(accounts))
+	sem := make(chan bool, parallelism)
+	var wg sync.WaitGroup
+	for i, addr := range accounts {
+		wg.Add(1)
+		sem <- true
+		go func(i int, addr string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			itemBase := responseBase{
+				Version: SchemaVersion,
+				Command: base.Command,
+				Account: addr,
+				Status:  StatusOK,
+			}
+			// a panic is confined to the address being served
+			defer func() {
+				if r := recover(); r != nil {
+					err := fmt.Errorf("Panic occurred during the task: %v", r)
+					lg.Printf("%s\n%s", err, debug.Stack())
+					results[i] = newResponseError(itemBase, err)
+				}
+			}()
+
+			result, err := runTask(ctx, acout, itemBase, opts)
+			if err != nil {
+				lg.Printf("Fails on the task for address %s: %s", addr, err)
+				result = newResponseError(itemBase, err)
+			}
+			results[i] = result
+		}(i, addr)
+	}
+	wg.Wait()
+
+	return responseBatch{base, results}
+}
+
+// rejectTask replies the error to the caller
+func rejectTask(lg2 logger.CustomLogger, tr transport.Transport, d transport.Delivery, enc replyEncoding, base responseBase, cause error) {
+	err := reply(tr, d, enc, base.RequestID, newResponseError(base, cause))
+	lg2.LogOnError(err, "Failed to reply the rejection of the task")
+}
+
+// settleDelivery acknowledges the delivery according to the outcome of the task
+// outcomeDone: acked
+// outcomeRetry: redelivered later with retry count increased
+// outcomeReject: dead-lettered to 'account_req_quarantine'
+func settleDelivery(lg2 logger.CustomLogger, tr transport.Transport, d transport.Delivery, outcome int) {
+	var err error
+	switch outcome {
+	case outcomeDone:
+		err = tr.Ack(d)
+	case outcomeRetry:
+		err = tr.Retry(d)
+	case outcomeReject:
+		err = tr.Nack(d, false)
+	case outcomeRequeue:
+		err = tr.Nack(d, true)
+	}
+	lg2.LogOnError(err, "Failed to settle the delivery")
+}
+
+// replyEncoding is the encoding of replies negotiated with the request
+type replyEncoding struct {
+	codec           codec.Codec
+	contentEncoding string
+}
+
+// encode encodes the result into the body of the reply
+func (enc replyEncoding) encode(result interface{}) ([]byte, error) {
+	body, err := enc.codec.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Compress(body, enc.contentEncoding)
+}
+
+// reply encodes the result and routes it to the caller of the delivery
+func reply(tr transport.Transport, d transport.Delivery, enc replyEncoding, requestID string, result interface{}) error {
+	body, err := enc.encode(result)
+	if err != nil {
+		return err
+	}
+	return tr.Reply(d, transport.Reply{
+		ContentType:     enc.codec.ContentType(),
+		ContentEncoding: enc.contentEncoding,
+		CorrelationID:   requestID,
+		Body:            body,
+	})
+}
@@ -0,0 +1,597 @@
+package worker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/golang/mock/gomock"
+	"github.com/junzhli/btcd-address-indexing-worker/account"
+	"github.com/junzhli/btcd-address-indexing-worker/btcd"
+	mockBtcd "github.com/junzhli/btcd-address-indexing-worker/btcd/mocks"
+	"github.com/junzhli/btcd-address-indexing-worker/codec"
+	mongoModel "github.com/junzhli/btcd-address-indexing-worker/mongo"
+	mockMongo "github.com/junzhli/btcd-address-indexing-worker/mongo/mocks"
+	rs "github.com/junzhli/btcd-address-indexing-worker/redis"
+	mockRedis "github.com/junzhli/btcd-address-indexing-worker/redis/mocks"
+	"github.com/junzhli/btcd-address-indexing-worker/redis/utils"
+	"github.com/junzhli/btcd-address-indexing-worker/transport"
+	"github.com/junzhli/btcd-address-indexing-worker/transport/memory"
+	"github.com/junzhli/btcd-address-indexing-worker/worker"
+)
+
+const address = "15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR"
+
+const rawTxs = `[
+	{
+		"txid": "5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d",
+		"vin": [
+			{
+				"txid": "d871dd21c020d84483ca7b95ed5b650bc78de617538d0ccdf3ecf32461a1e1b9",
+				"vout": 1,
+				"prevOut": {
+					"addresses": ["1A5ehPU5W3VxkuvKWLSyYdAfK2YMdsJiaq"]
+				}
+			}
+		],
+		"vout": [
+			{
+				"value": 0.9486,
+				"scriptPubKey": {
+					"hex": "76a9144a3681ee9e3451bd4c24f68eafb65ec832e9ec0e88ac",
+					"addresses": ["17mQJSt7v2w2FTrP8MnBjTBPffgVgBdkJ3"]
+				}
+			},
+			{
+				"value": 1.60720958,
+				"scriptPubKey": {
+					"hex": "76a9143224060e14d6cf0d2e225a2a2f3aa8779de4226b88ac",
+					"addresses": ["15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR"]
+				}
+			}
+		],
+		"blockhash": "00000000000000000025bbf5ebe2ab7e424d10afb4857270695ae6403b068a06",
+		"confirmations": 58145,
+		"blocktime": 1540994884
+	}
+]`
+
+// newHarness wires the worker to mocked backends which serve rawTxs for a new address
+func newHarness(t *testing.T) (*worker.Config, *memory.Memory, *gomock.Controller) {
+	var stored *mongoModel.UserHistory
+	return newHarnessWith(t, parseTxs(t, rawTxs), &stored)
+}
+
+// newHarnessWith wires the worker to mocked backends which serve txs for a new address
+// and keeps the user history persisted to stored
+func newHarnessWith(t *testing.T, txHistory []btcd.ResponseSearchRawTransactions, stored **mongoModel.UserHistory) (*worker.Config, *memory.Memory, *gomock.Controller) {
+	mockCtrl := gomock.NewController(t)
+	node := mockBtcd.NewMockBtcd(mockCtrl)
+	mongo := mockMongo.NewMockMongo(mockCtrl)
+	redis := mockRedis.NewMockRedis(mockCtrl)
+
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	redis.EXPECT().Get(stateKey).Return(rs.StateNew, nil).Times(1)
+	node.EXPECT().SearchRawTransactions(address, int64(0), int64(2000)).Return(&txHistory, nil).Times(1)
+	node.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(660000)}, nil).AnyTimes()
+	mongo.EXPECT().PutUserHistory(gomock.Any()).Do(func(history *mongoModel.UserHistory) {
+		*stored = history
+	}).Return(nil).Times(1)
+	redis.EXPECT().Set(utils.GenCacheKey(address, rs.CommandAll), gomock.Any(), gomock.Any()).Return(nil).Times(1)
+	redis.EXPECT().Del(stateKey).Return(nil).Times(1)
+
+	config := &worker.Config{
+		Account: &account.Config{
+			Btcd:                  node,
+			Mongo:                 mongo,
+			Redis:                 redis,
+			RequiredConfirmations: 6,
+		},
+		MaxRetries:       3,
+		BatchConcurrency: 1,
+	}
+	return config, memory.New(1), mockCtrl
+}
+
+// parseTxs decodes the transactions served by btcd
+func parseTxs(t *testing.T, txs string) []btcd.ResponseSearchRawTransactions {
+	var txHistory []btcd.ResponseSearchRawTransactions
+	if err := json.Unmarshal([]byte(txs), &txHistory); err != nil {
+		t.Fatal(err)
+	}
+	return txHistory
+}
+
+// serve pushes the request through the transport and runs the task picked up
+func serve(t *testing.T, config *worker.Config, tr *memory.Memory, d transport.Delivery) {
+	if err := tr.Push(d); err != nil {
+		t.Fatal(err)
+	}
+	worker.DoTask(0, <-tr.Deliveries(), config, tr)
+}
+
+// assertReplied checks the only reply and settlement of the task
+func assertReplied(t *testing.T, tr *memory.Memory, queue string, expected string, outcome string) {
+	messages := tr.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 reply, got %d", len(messages))
+	}
+	if messages[0].Queue != queue {
+		t.Errorf("Expected reply routed to %s, got %s", queue, messages[0].Queue)
+	}
+	if body := string(messages[0].Reply.Body); body != expected {
+		t.Errorf("Unexpected reply\nexpected: %s\ngot:      %s", expected, body)
+	}
+
+	settlements := tr.Settlements()
+	if len(settlements) != 1 || settlements[0].Outcome != outcome {
+		t.Errorf("Expected the delivery settled with %s, got %v", outcome, settlements)
+	}
+}
+
+func TestDoTaskAll(t *testing.T) {
+	config, tr, mockCtrl := newHarness(t)
+	defer mockCtrl.Finish()
+
+	serve(t, config, tr, transport.Delivery{
+		Body:          []byte(`{"account":"` + address + `","task":"all"}`),
+		CorrelationID: "req-1",
+		ReplyTo:       "caller",
+	})
+
+	expected := `{"version":1,"command":"all","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-1","status":"ok",` +
+		`"data":{"balance":1.60720958,` +
+		`"transactions":["5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d"],` +
+		`"unspents":[{"Transaction":"5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d","VOutIdx":1,` +
+		`"ScriptPubKey":"76a9143224060e14d6cf0d2e225a2a2f3aa8779de4226b88ac","Amount":160720958,"BlockTime":1540994884}],` +
+		`"confirmed":1.60720958,"unconfirmed":0,"pending":{"incoming":[],"outgoing":[]}}}`
+	assertReplied(t, tr, "caller", expected, memory.OutcomeAck)
+}
+
+func TestDoTaskUnspents(t *testing.T) {
+	config, tr, mockCtrl := newHarness(t)
+	defer mockCtrl.Finish()
+
+	serve(t, config, tr, transport.Delivery{
+		Body: []byte(`{"account":"` + address + `","task":"unspents","requestId":"req-2"}`),
+	})
+
+	expected := `{"version":1,"command":"unspents","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-2","status":"ok",` +
+		`"data":[{"Transaction":"5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d","VOutIdx":1,` +
+		`"ScriptPubKey":"76a9143224060e14d6cf0d2e225a2a2f3aa8779de4226b88ac","Amount":160720958,"BlockTime":1540994884}],"total":1}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeAck)
+}
+
+func TestDoTaskUnsupported(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	config := &worker.Config{
+		Account: &account.Config{
+			Btcd:  mockBtcd.NewMockBtcd(mockCtrl),
+			Mongo: mockMongo.NewMockMongo(mockCtrl),
+			Redis: mockRedis.NewMockRedis(mockCtrl),
+		},
+	}
+	tr := memory.New(1)
+
+	serve(t, config, tr, transport.Delivery{
+		Body:          []byte(`{"account":"` + address + `","task":"ledger"}`),
+		CorrelationID: "req-3",
+	})
+
+	expected := `{"version":1,"command":"ledger","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-3","status":"error",` +
+		`"error":{"code":"unsupported_task","message":"Unsupported task: ledger","retryable":false}}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeQuarantine)
+}
+
+func TestDoTaskStream(t *testing.T) {
+	config, tr, mockCtrl := newHarness(t)
+	defer mockCtrl.Finish()
+
+	serve(t, config, tr, transport.Delivery{
+		Body:          []byte(`{"account":"` + address + `","task":"all","stream":true,"chunkSize":1}`),
+		CorrelationID: "req-4",
+	})
+
+	expected := []string{
+		`{"version":1,"command":"all","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-4","status":"ok","sequence":0,"final":false,` +
+			`"data":{"balance":1.60720958,"transactions":["5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d"],"unspents":[],` +
+			`"confirmed":1.60720958,"unconfirmed":0,"pending":{"incoming":[],"outgoing":[]}}}`,
+		`{"version":1,"command":"all","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-4","status":"ok","sequence":1,"final":true,` +
+			`"data":{"balance":1.60720958,"transactions":[],` +
+			`"unspents":[{"Transaction":"5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d","VOutIdx":1,` +
+			`"ScriptPubKey":"76a9143224060e14d6cf0d2e225a2a2f3aa8779de4226b88ac","Amount":160720958,"BlockTime":1540994884}],` +
+			`"confirmed":1.60720958,"unconfirmed":0,"pending":{"incoming":[],"outgoing":[]}}}`,
+	}
+	messages := tr.Messages()
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected %d chunks, got %d", len(expected), len(messages))
+	}
+	for i, message := range messages {
+		if message.Reply.CorrelationID != "req-4" {
+			t.Errorf("Expected chunk %d correlated with req-4, got %s", i, message.Reply.CorrelationID)
+		}
+		if body := string(message.Reply.Body); body != expected[i] {
+			t.Errorf("Unexpected chunk %d\nexpected: %s\ngot:      %s", i, expected[i], body)
+		}
+	}
+}
+
+func TestDoTaskMsgpack(t *testing.T) {
+	config, tr, mockCtrl := newHarness(t)
+	defer mockCtrl.Finish()
+
+	c := codec.ForContentType(codec.ContentTypeMsgpack)
+	body, err := c.Marshal(map[string]interface{}{
+		"account":        address,
+		"task":           "unspents",
+		"acceptEncoding": codec.EncodingGzip,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, config, tr, transport.Delivery{
+		Body:        body,
+		ContentType: codec.ContentTypeMsgpack,
+	})
+
+	messages := tr.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 reply, got %d", len(messages))
+	}
+	reply := messages[0].Reply
+	if reply.ContentType != codec.ContentTypeMsgpack || reply.ContentEncoding != codec.EncodingGzip {
+		t.Fatalf("Unexpected encoding of reply %s %s", reply.ContentType, reply.ContentEncoding)
+	}
+	res, err := codec.Decompress(reply.Body, reply.ContentEncoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same field names as JSON
+	var result struct {
+		Command string `json:"command"`
+		Status  string `json:"status"`
+		Total   int    `json:"total"`
+		Data    []struct {
+			Transaction string
+			Amount      uint64
+		} `json:"data"`
+	}
+	if err := c.Unmarshal(res, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Command != "unspents" || result.Status != "ok" || result.Total != 1 || len(result.Data) != 1 ||
+		result.Data[0].Transaction != "5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d" || result.Data[0].Amount != 160720958 {
+		t.Errorf("Unexpected reply %+v", result)
+	}
+}
+
+func TestDoTaskValidation(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	config := &worker.Config{
+		Account: &account.Config{
+			Btcd:  mockBtcd.NewMockBtcd(mockCtrl),
+			Mongo: mockMongo.NewMockMongo(mockCtrl),
+			Redis: mockRedis.NewMockRedis(mockCtrl),
+		},
+	}
+	tr := memory.New(1)
+
+	serve(t, config, tr, transport.Delivery{
+		Body: []byte(`{"version":1,"account":"` + address + `","task":"balance","limit":10}`),
+	})
+
+	expected := `{"version":1,"command":"balance","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","status":"error",` +
+		`"error":{"code":"invalid_request","message":"Invalid field 'task': pagination applies to tasks transactions, unspents and history only",` +
+		`"retryable":false,"field":"task"}}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeQuarantine)
+}
+
+func TestDoTaskBalanceAtBeforeGenesis(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	config := &worker.Config{
+		Account: &account.Config{
+			Btcd:  mockBtcd.NewMockBtcd(mockCtrl),
+			Mongo: mockMongo.NewMockMongo(mockCtrl),
+			Redis: mockRedis.NewMockRedis(mockCtrl),
+		},
+	}
+	tr := memory.New(1)
+
+	serve(t, config, tr, transport.Delivery{
+		Body: []byte(`{"account":"` + address + `","task":"balanceAt","timestamp":"1900-01-01T00:00:00Z"}`),
+	})
+
+	expected := `{"version":1,"command":"balanceAt","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","status":"error",` +
+		`"error":{"code":"invalid_request","message":"Invalid field 'timestamp': must not be before the genesis block",` +
+		`"retryable":false,"field":"timestamp"}}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeQuarantine)
+}
+
+func TestDoTaskBatchSize(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	config := &worker.Config{
+		Account: &account.Config{
+			Btcd:  mockBtcd.NewMockBtcd(mockCtrl),
+			Mongo: mockMongo.NewMockMongo(mockCtrl),
+			Redis: mockRedis.NewMockRedis(mockCtrl),
+		},
+		MaxBatchSize: 1,
+	}
+	tr := memory.New(1)
+
+	serve(t, config, tr, transport.Delivery{
+		Body: []byte(`{"accounts":["` + address + `","` + address + `"],"task":"balance"}`),
+	})
+
+	expected := `{"version":1,"command":"balance","account":"","status":"error",` +
+		`"error":{"code":"invalid_request","message":"Invalid field 'accounts': must hold no more than 1 addresses",` +
+		`"retryable":false,"field":"accounts"}}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeQuarantine)
+}
+
+func TestDoTaskCancelled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	config := &worker.Config{
+		Account: &account.Config{
+			Btcd:  mockBtcd.NewMockBtcd(mockCtrl),
+			Mongo: mockMongo.NewMockMongo(mockCtrl),
+			Redis: mockRedis.NewMockRedis(mockCtrl),
+		},
+		MaxRetries: 3,
+	}
+	tr := memory.New(1)
+	if err := tr.Push(transport.Delivery{Body: []byte(`{"account":"` + address + `","task":"balance"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// shutdown has cancelled the task in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	worker.DoTaskContext(ctx, 0, <-tr.Deliveries(), config, tr)
+
+	if messages := tr.Messages(); len(messages) != 0 {
+		t.Errorf("Expected no reply for the aborted task, got %v", messages)
+	}
+	settlements := tr.Settlements()
+	if len(settlements) != 1 || settlements[0].Outcome != memory.OutcomeRequeue {
+		t.Errorf("Expected the delivery requeued, got %v", settlements)
+	}
+}
+
+func TestDoTaskSatoshi(t *testing.T) {
+	config, tr, mockCtrl := newHarness(t)
+	defer mockCtrl.Finish()
+
+	serve(t, config, tr, transport.Delivery{
+		Body:          []byte(`{"account":"` + address + `","task":"all","units":"satoshi"}`),
+		CorrelationID: "req-5",
+	})
+
+	expected := `{"version":1,"command":"all","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-5","status":"ok",` +
+		`"data":{"balance":160720958,"balanceBtc":"1.60720958",` +
+		`"transactions":["5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d"],` +
+		`"unspents":[{"Transaction":"5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d","VOutIdx":1,` +
+		`"ScriptPubKey":"76a9143224060e14d6cf0d2e225a2a2f3aa8779de4226b88ac","Amount":160720958,"BlockTime":1540994884}],` +
+		`"confirmed":160720958,"unconfirmed":0,"pending":{"incoming":[],"outgoing":[]}}}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeAck)
+}
+
+// pendingTx spends the output of rawTxs with change back, which is not confirmed yet
+const pendingTx = `{
+	"txid": "f74918c59110c5389c5b935d01e54428eb33e6180deb90abef22cd8d8100e3ff",
+	"vin": [
+		{
+			"txid": "5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d",
+			"vout": 1,
+			"prevOut": {
+				"addresses": ["15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR"]
+			}
+		}
+	],
+	"vout": [
+		{
+			"value": 1.1,
+			"scriptPubKey": {
+				"hex": "a91466d7080ddfe69e5803d5b40548f8c1175d84f80387",
+				"addresses": ["3B4nSkwKYhW9ojUArcJTqRrF5SXKEpafv7"]
+			}
+		},
+		{
+			"value": 0.5,
+			"scriptPubKey": {
+				"hex": "76a9143224060e14d6cf0d2e225a2a2f3aa8779de4226b88ac",
+				"addresses": ["15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR"]
+			}
+		}
+	],
+	"confirmations": 0
+}`
+
+// spendingTxs returns rawTxs followed by pendingTx confirmed the times in the block of the time
+// Zero confirmations leave it pending
+func spendingTxs(t *testing.T, confirmations uint64, blocktime uint64) []btcd.ResponseSearchRawTransactions {
+	spending := parseTxs(t, "["+pendingTx+"]")[0]
+	spending.Confirmations = confirmations
+	spending.Blocktime = blocktime
+	return append(parseTxs(t, rawTxs), spending)
+}
+
+func TestDoTaskPending(t *testing.T) {
+	var stored *mongoModel.UserHistory
+	config, tr, mockCtrl := newHarnessWith(t, spendingTxs(t, 0, 0), &stored)
+	defer mockCtrl.Finish()
+
+	serve(t, config, tr, transport.Delivery{
+		Body:          []byte(`{"account":"` + address + `","task":"balance","units":"satoshi"}`),
+		CorrelationID: "req-6",
+	})
+
+	expected := `{"version":1,"command":"balance","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-6","status":"ok",` +
+		`"data":160720958,"balanceBtc":"1.60720958","confirmed":160720958,"unconfirmed":-110720958,` +
+		`"pending":{"incoming":[],"outgoing":["f74918c59110c5389c5b935d01e54428eb33e6180deb90abef22cd8d8100e3ff"]}}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeAck)
+
+	if stored == nil || len(stored.Transactions) != 1 || len(stored.Unspents) != 1 || stored.Subtotal != 160720958 {
+		t.Errorf("Expected only the confirmed transaction persisted, got %+v", stored)
+	}
+}
+
+func TestDoTaskMinConfirmations(t *testing.T) {
+	var stored *mongoModel.UserHistory
+	config, tr, mockCtrl := newHarnessWith(t, spendingTxs(t, 3, 0), &stored)
+	defer mockCtrl.Finish()
+
+	serve(t, config, tr, transport.Delivery{
+		Body:          []byte(`{"account":"` + address + `","task":"balance","units":"satoshi","minConfirmations":10}`),
+		CorrelationID: "req-7",
+	})
+
+	// the shallow transaction is taken as pending
+	expected := `{"version":1,"command":"balance","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-7","status":"ok",` +
+		`"data":160720958,"balanceBtc":"1.60720958","confirmed":160720958,"unconfirmed":-110720958,` +
+		`"pending":{"incoming":[],"outgoing":["f74918c59110c5389c5b935d01e54428eb33e6180deb90abef22cd8d8100e3ff"]}}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeAck)
+
+	if stored == nil || len(stored.Transactions) != 1 {
+		t.Errorf("Expected only the transaction confirmed more than required persisted, got %+v", stored)
+	}
+}
+
+func TestDoTaskHistory(t *testing.T) {
+	var stored *mongoModel.UserHistory
+	config, tr, mockCtrl := newHarnessWith(t, spendingTxs(t, 3, 0), &stored)
+	defer mockCtrl.Finish()
+
+	serve(t, config, tr, transport.Delivery{
+		Body:          []byte(`{"account":"` + address + `","task":"history"}`),
+		CorrelationID: "req-8",
+	})
+
+	expected := `{"version":1,"command":"history","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-8","status":"ok","data":[` +
+		`{"txid":"5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d","blockTime":1540994884,"height":601856,"confirmations":58145,` +
+		`"received":160720958,"sent":0,"net":160720958},` +
+		`{"txid":"f74918c59110c5389c5b935d01e54428eb33e6180deb90abef22cd8d8100e3ff","blockTime":0,"height":659998,"confirmations":3,` +
+		`"received":50000000,"sent":160720958,"net":-110720958}],"total":2}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeAck)
+
+	if stored == nil || len(stored.Details) != 1 || stored.Details[0].Height != 601856 {
+		t.Errorf("Expected details of the stored transaction persisted, got %+v", stored)
+	}
+}
+
+func TestDoTaskBalanceAt(t *testing.T) {
+	var stored *mongoModel.UserHistory
+	config, tr, mockCtrl := newHarnessWith(t, spendingTxs(t, 3, 0), &stored)
+	defer mockCtrl.Finish()
+
+	// the block before the one spending the output
+	serve(t, config, tr, transport.Delivery{
+		Body:          []byte(`{"account":"` + address + `","task":"balanceAt","height":659997,"units":"satoshi"}`),
+		CorrelationID: "req-9",
+	})
+
+	expected := `{"version":1,"command":"balanceAt","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-9","status":"ok",` +
+		`"data":160720958,"balanceBtc":"1.60720958","height":659997,` +
+		`"unspents":[{"Transaction":"5cf66fd258a5d2be04051134b11bd794a65e149bbbfc1f32e8f18841997e936d","VOutIdx":1,` +
+		`"ScriptPubKey":"76a9143224060e14d6cf0d2e225a2a2f3aa8779de4226b88ac","Amount":160720958,"BlockTime":1540994884}]}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeAck)
+
+	if stored == nil || stored.Spenders == nil {
+		t.Errorf("Expected spenders of stored outputs persisted, got %+v", stored)
+	}
+}
+
+func TestDoTaskBalanceSeries(t *testing.T) {
+	var stored *mongoModel.UserHistory
+	config, tr, mockCtrl := newHarnessWith(t, spendingTxs(t, 3, 1541030400), &stored)
+	defer mockCtrl.Finish()
+
+	serve(t, config, tr, transport.Delivery{
+		Body: []byte(`{"account":"` + address + `","task":"balanceSeries","interval":"month",` +
+			`"from":"2018-10-15T00:00:00Z","to":"2018-11-15T00:00:00Z"}`),
+		CorrelationID: "req-10",
+	})
+
+	expected := `{"version":1,"command":"balanceSeries","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-10","status":"ok",` +
+		`"data":[{"time":"2018-10-31T23:59:59Z","balance":160720958},{"time":"2018-11-15T00:00:00Z","balance":50000000}],"interval":"month"}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeAck)
+}
+
+func TestDoTaskBalanceSeriesTooLong(t *testing.T) {
+	config, tr, mockCtrl := newHarness(t)
+	defer mockCtrl.Finish()
+	config.Account.MaxSeriesPoints = 31
+
+	serve(t, config, tr, transport.Delivery{
+		Body: []byte(`{"account":"` + address + `","task":"balanceSeries","interval":"day",` +
+			`"from":"2018-10-01T00:00:00Z","to":"2018-11-01T00:00:00Z"}`),
+		CorrelationID: "req-11",
+	})
+
+	expected := `{"version":1,"command":"balanceSeries","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-11","status":"error",` +
+		`"error":{"code":"invalid_request","message":"Balance series holds more than 31 points, narrow down the range or widen the interval","retryable":false}}`
+	assertReplied(t, tr, transport.NameReply, expected, memory.OutcomeAck)
+}
+
+func TestDoTaskRetry(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	node := mockBtcd.NewMockBtcd(mockCtrl)
+	mongo := mockMongo.NewMockMongo(mockCtrl)
+	redis := mockRedis.NewMockRedis(mockCtrl)
+
+	txHistory := parseTxs(t, rawTxs)
+	stateKey := utils.GenStateKey(address, rs.CommandAll)
+	cacheKey := utils.GenCacheKey(address, rs.CommandAll)
+	// the first attempt fails on btcd
+	first := redis.EXPECT().Get(stateKey).Return(rs.StateNew, nil).Times(1)
+	failed := node.EXPECT().SearchRawTransactions(address, int64(0), int64(2000)).Return(nil, errors.New("connection refused")).Times(1).After(first)
+	released := redis.EXPECT().Del(stateKey).Return(nil).Times(1).After(failed)
+	// the retry goes without the state key removed
+	miss := redis.EXPECT().Get(cacheKey).Return("", goredis.Nil).Times(1).After(released)
+	mongo.EXPECT().GetUserHistory(address).Return(nil, errors.New(mongoModel.ErrorNoUserInfo)).Times(1).After(miss)
+	node.EXPECT().SearchRawTransactions(address, int64(0), int64(2000)).Return(&txHistory, nil).Times(1).After(miss)
+	node.EXPECT().GetInfo().Return(&map[string]interface{}{"blocks": float64(660000)}, nil).AnyTimes()
+	mongo.EXPECT().PutUserHistory(gomock.Any()).Return(nil).Times(1)
+	redis.EXPECT().Set(cacheKey, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+	config := &worker.Config{
+		Account: &account.Config{
+			Btcd:                  node,
+			Mongo:                 mongo,
+			Redis:                 redis,
+			RequiredConfirmations: 6,
+		},
+		MaxRetries:       3,
+		BatchConcurrency: 1,
+	}
+	tr := memory.New(1)
+
+	serve(t, config, tr, transport.Delivery{
+		Body:          []byte(`{"account":"` + address + `","task":"balance","units":"satoshi"}`),
+		CorrelationID: "req-11",
+	})
+	if messages := tr.Messages(); len(messages) != 0 {
+		t.Fatalf("Expected no reply before retry, got %d", len(messages))
+	}
+	worker.DoTask(0, <-tr.Deliveries(), config, tr)
+
+	settlements := tr.Settlements()
+	if len(settlements) != 2 || settlements[0].Outcome != memory.OutcomeRetry || settlements[1].Outcome != memory.OutcomeAck {
+		t.Fatalf("Expected the delivery retried and then acked, got %v", settlements)
+	}
+	messages := tr.Messages()
+	expected := `{"version":1,"command":"balance","account":"15a7wZQhCeQ457KzxRZbeJ8jobb6yMVubR","requestId":"req-11","status":"ok",` +
+		`"data":160720958,"balanceBtc":"1.60720958","confirmed":160720958,"unconfirmed":0,"pending":{"incoming":[],"outgoing":[]}}`
+	if len(messages) != 1 || string(messages[0].Reply.Body) != expected {
+		t.Errorf("Unexpected replies %v", messages)
+	}
+}